@@ -0,0 +1,148 @@
+// checkpoint.go
+package checkpoint
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// magic is the first line of every checkpoint file
+const magic = "GOL-CHECKPOINT 1"
+
+// Checkpoint is everything needed to resume a simulation: the world as of a turn and the
+// parameters it was started with.
+//
+// On disk a checkpoint is a short text header of "key value" lines, ending with a "data" line,
+// followed by the world as raw rows of ImageWidth bytes, one byte per cell. A generator line is
+// only written for worlds that were generated:
+//
+//	GOL-CHECKPOINT 1
+//	width 512
+//	height 512
+//	turn 1200
+//	turns 10000000000
+//	rule B3/S23
+//	topology torus
+//	generator generate=soup symmetry=D4 density=0.5 seed=42
+//	data
+type Checkpoint struct {
+	ImageWidth  int
+	ImageHeight int
+	Turn        int    // Number of turns completed when the checkpoint was taken
+	Turns       int    // Number of turns the simulation was asked to process
+	Rule        string // Rule set in Birth/Survival or Larger than Life notation
+	Topology    string // Surface the world is drawn on; empty for a torus
+	Generator   string // Options the initial world was generated with; empty if it was loaded
+	World       [][]byte
+}
+
+// Write saves a checkpoint to path. The file is written alongside and then renamed into place,
+// so a crash part way through never leaves a truncated checkpoint behind.
+func Write(path string, c Checkpoint) error {
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	err = write(file, c)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+func write(file io.Writer, c Checkpoint) error {
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, magic)
+	fmt.Fprintln(w, "width", c.ImageWidth)
+	fmt.Fprintln(w, "height", c.ImageHeight)
+	fmt.Fprintln(w, "turn", c.Turn)
+	fmt.Fprintln(w, "turns", c.Turns)
+	fmt.Fprintln(w, "rule", c.Rule)
+	fmt.Fprintln(w, "topology", c.Topology)
+	if c.Generator != "" {
+		fmt.Fprintln(w, "generator", c.Generator)
+	}
+	fmt.Fprintln(w, "data")
+	for _, row := range c.World {
+		w.Write(row)
+	}
+	return w.Flush()
+}
+
+// Read loads a checkpoint written by Write.
+func Read(path string) (Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	defer file.Close()
+
+	c, err := read(bufio.NewReader(file))
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("%v: %w", path, err)
+	}
+	return c, nil
+}
+
+func read(r *bufio.Reader) (Checkpoint, error) {
+	var c Checkpoint
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != magic {
+		return c, errors.New("not a checkpoint file")
+	}
+
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return c, errors.New("header ends before the world data")
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		key, value := fields[0], ""
+		if len(fields) == 2 {
+			value = fields[1]
+		}
+		switch key {
+		case "data":
+			if c.ImageWidth <= 0 || c.ImageHeight <= 0 {
+				return c, fmt.Errorf("invalid world size %dx%d", c.ImageWidth, c.ImageHeight)
+			}
+			c.World = make([][]byte, c.ImageHeight)
+			for y := range c.World {
+				c.World[y] = make([]byte, c.ImageWidth)
+				_, err = io.ReadFull(r, c.World[y])
+				if err != nil {
+					return c, fmt.Errorf("world data ends at row %v", y)
+				}
+			}
+			return c, nil
+		case "width":
+			c.ImageWidth, err = strconv.Atoi(value)
+		case "height":
+			c.ImageHeight, err = strconv.Atoi(value)
+		case "turn":
+			c.Turn, err = strconv.Atoi(value)
+		case "turns":
+			c.Turns, err = strconv.Atoi(value)
+		case "rule":
+			c.Rule = value
+		case "topology":
+			c.Topology = value
+		case "generator":
+			c.Generator = value
+		}
+		// Keys this version does not know about are skipped
+		if err != nil {
+			return c, fmt.Errorf("invalid %v: %w", key, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// engine.go
+package engine
+
+import "uk.ac.bris.cs/gameoflife/util"
+
+// NextWorld performs a single evolution of the whole world, with its edges joined up by the topology.
+func NextWorld(world [][]byte, height, width int, rule Rule, topology Topology) [][]byte {
+	// Wrap the world in references to its own edge rows so it can be treated as a strip.
+	strip := make([][]byte, 0, height+2*rule.Radius)
+	for y := -rule.Radius; y < height+rule.Radius; y++ {
+		strip = append(strip, world[(y%height+height)%height])
+	}
+	var sides [][]byte
+	if topology.NeedsSides() {
+		sides = SideColumns(world, rule.Radius)
+	}
+	return NextStrip(strip, 0, height, width, rule, topology, sides)
+}
+
+// NextStrip evolves a horizontal strip of the world, starting at row startY, by one turn.
+// The first and last rule.Radius rows of strip are halo rows borrowed from the neighbouring strips,
+// wrapping around the top and bottom of the world; the topology decides whether cells beyond those
+// edges are dead, or are found in the halo rows as they are or mirrored. Only the rows between the
+// halos are evolved and returned. sides holds the side columns of the whole world when the topology
+// needs them.
+func NextStrip(strip [][]byte, startY, height, width int, rule Rule, topology Topology, sides [][]byte) [][]byte {
+	r := rule.Radius
+
+	// Widen every row so that neighbours can be counted without wrapping
+	padded := make([][]byte, len(strip))
+	for i, row := range strip {
+		padded[i] = topology.padRow(row, startY-r+i, height, width, r, sides)
+	}
+
+	if rule.packable() {
+		// Count 64 cells' neighbours at once
+		return nextPackedStrip(padded, width, rule)
+	}
+
+	stripHeight := len(strip) - 2*r
+	newStrip := make([][]byte, stripHeight)
+	for i := range newStrip {
+		newStrip[i] = make([]byte, width)
+	}
+
+	neighbours := rule.neighbours()
+	for y := 0; y < stripHeight; y++ {
+		for x := 0; x < width; x++ {
+			aliveNeighbors := countAliveNeighbors(padded, x+r, y+r, neighbours)
+
+			// Apply the rule set
+			newStrip[y][x] = rule.Next(strip[y+r][x], aliveNeighbors)
+		}
+	}
+
+	return newStrip
+}
+
+// countAliveNeighbors counts alive neighbors for a cell at (x, y) of a strip.
+// Rows must already be padded with halos and side columns.
+func countAliveNeighbors(strip [][]byte, x, y int, neighbours []offset) int {
+	liveNeighbors := 0
+	for _, n := range neighbours {
+		if strip[y+n.dy][x+n.dx] == 255 {
+			liveNeighbors++
+		}
+	}
+	return liveNeighbors
+}
+
+// CountAliveCells counts the number of alive cells in the world.
+// Dying cells of Generations rules are not alive.
+func CountAliveCells(world [][]byte) int {
+	aliveCount := 0
+	for y := 0; y < len(world); y++ {
+		for x := 0; x < len(world[y]); x++ {
+			if world[y][x] == 255 { // Alive cell
+				aliveCount++
+			}
+		}
+	}
+	return aliveCount
+}
+
+// FindAliveCells collects the coordinates of all live cells in the world.
+// Dying cells of Generations rules are not alive.
+func FindAliveCells(world [][]byte) []util.Cell {
+	aliveCells := []util.Cell{}
+	for y := 0; y < len(world); y++ {
+		for x := 0; x < len(world[y]); x++ {
+			if world[y][x] == 255 { // Alive cell
+				aliveCells = append(aliveCells, util.Cell{Y: y, X: x})
+			}
+		}
+	}
+	return aliveCells
+}
+
+// ChangedCells lists the cells that differ between two versions of a strip, adding startY to each row,
+// along with the grey level each has changed to.
+func ChangedCells(before, after [][]byte, startY int) ([]util.Cell, []byte) {
+	var cells []util.Cell
+	var greys []byte
+	for y := range after {
+		for x := range after[y] {
+			if before[y][x] != after[y][x] {
+				cells = append(cells, util.Cell{X: x, Y: y + startY})
+				greys = append(greys, after[y][x])
+			}
+		}
+	}
+	return cells, greys
+}
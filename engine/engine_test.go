@@ -0,0 +1,39 @@
+// engine_test.go
+package engine
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestNonSquare runs every engine for 30 turns on a world wider than it is tall, against the reference.
+func TestNonSquare(t *testing.T) {
+	forEachCase(t, [][2]int{{70, 48}, {48, 70}}, func(t *testing.T, rule Rule, topology Topology, width, height int) {
+		world := randomWorld(rand.New(rand.NewSource(9)), height, width, rule)
+		var grid Grid
+		if rule.States == 2 {
+			grid = PackGrid(world, height, width)
+		}
+		sparse := NewSparse(world, 0, height, width, rule, topology)
+		for turn := 1; turn <= 30; turn++ {
+			want := referenceNext(world, height, width, rule, topology)
+			if diff := firstDifference(NextWorld(world, height, width, rule, topology), want); diff != "" {
+				t.Fatalf("turn %v: NextWorld: %v", turn, diff)
+			}
+			if diff := firstDifference(nextInStrips(world, height, width, 4, rule, topology), want); diff != "" {
+				t.Fatalf("turn %v: NextStrip: %v", turn, diff)
+			}
+			if rule.States == 2 {
+				grid = grid.Next(rule, topology)
+				if diff := firstDifference(grid.Unpack(), want); diff != "" {
+					t.Fatalf("turn %v: Grid: %v", turn, diff)
+				}
+			}
+			sparse.StepWorld()
+			if diff := firstDifference(sparse.Strip(), want); diff != "" {
+				t.Fatalf("turn %v: Sparse: %v", turn, diff)
+			}
+			world = want
+		}
+	})
+}
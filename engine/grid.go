@@ -0,0 +1,255 @@
+// grid.go
+package engine
+
+import (
+	"math/bits"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// Grid is a world of two-state cells packed one bit to a cell, 64 to a word. It takes an eighth of
+// the memory of a world of grey levels, and lets 64 cells be evolved at once.
+type Grid struct {
+	Width  int
+	Height int
+	stride int // Words per row
+	words  []uint64
+}
+
+// NewGrid makes a grid of dead cells.
+func NewGrid(width, height int) Grid {
+	stride := (width + 63) / 64
+	return Grid{Width: width, Height: height, stride: stride, words: make([]uint64, stride*height)}
+}
+
+// PackGrid packs a world of grey levels into a grid, in which only the cells at 255 are alive.
+func PackGrid(world [][]byte, height, width int) Grid {
+	g := NewGrid(width, height)
+	for y := 0; y < height; y++ {
+		packRow(g.Row(y), world[y])
+	}
+	return g
+}
+
+// GridFromWords makes a grid out of words laid out as Words gives them.
+func GridFromWords(words []uint64, height, width int) Grid {
+	g := NewGrid(width, height)
+	copy(g.words, words)
+	return g
+}
+
+// Words gives the packed cells, one row after another, each row starting on a new word.
+// Bit x%64 of word x/64 of a row holds the cell in column x.
+func (g Grid) Words() []uint64 {
+	return g.words
+}
+
+// Row gives the words holding a row of the grid.
+func (g Grid) Row(y int) []uint64 {
+	return g.words[y*g.stride : (y+1)*g.stride]
+}
+
+// Alive reports whether the cell at (x, y) is alive.
+func (g Grid) Alive(x, y int) bool {
+	return g.Row(y)[x>>6]>>(x&63)&1 != 0
+}
+
+// Set brings the cell at (x, y) to life or kills it.
+func (g Grid) Set(x, y int, alive bool) {
+	row := g.Row(y)
+	if alive {
+		row[x>>6] |= 1 << (x & 63)
+	} else {
+		row[x>>6] &^= 1 << (x & 63)
+	}
+}
+
+// Unpack gives the grid as a world of grey levels.
+func (g Grid) Unpack() [][]byte {
+	world := make([][]byte, g.Height)
+	for y := range world {
+		world[y] = make([]byte, g.Width)
+		unpackRow(world[y], g.Row(y))
+	}
+	return world
+}
+
+// CountAlive counts the alive cells in the grid.
+func (g Grid) CountAlive() int {
+	count := 0
+	for _, word := range g.words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// AliveCells lists the alive cells in the grid.
+func (g Grid) AliveCells() []util.Cell {
+	var cells []util.Cell
+	for y := 0; y < g.Height; y++ {
+		for i, word := range g.Row(y) {
+			for word != 0 {
+				bit := bits.TrailingZeros64(word)
+				cells = append(cells, util.Cell{X: i*64 + bit, Y: y})
+				word &= word - 1
+			}
+		}
+	}
+	return cells
+}
+
+// Next performs a single evolution of the grid, with its edges joined up by the topology.
+// Rules with more than two states cannot be packed, so must be evolved with NextWorld instead.
+func (g Grid) Next(rule Rule, topology Topology) Grid {
+	if !rule.packable() {
+		return PackGrid(NextWorld(g.Unpack(), g.Height, g.Width, rule, topology), g.Height, g.Width)
+	}
+	next := NewGrid(g.Width, g.Height)
+	kernel := newPackedKernel(rule)
+	rows := [3][]uint64{g.paddedRow(-1, topology), g.paddedRow(0, topology), nil}
+	for y := 0; y < g.Height; y++ {
+		rows[2] = g.paddedRow(y+1, topology)
+		kernel.step(next.Row(y), rows, g.Width)
+		rows[0], rows[1] = rows[1], rows[2]
+	}
+	return next
+}
+
+// paddedRow gives row y of the grid, which may be beyond the top or bottom edge, shifted along by one
+// cell so that bit 0 holds the cell beyond the left edge and bit Width+1 the cell beyond the right edge.
+func (g Grid) paddedRow(y int, topology Topology) []uint64 {
+	padded := make([]uint64, paddedStride(g.Width))
+	set := func(x int) {
+		cx, cy, ok := topology.locate(x, y, g.Width, g.Height)
+		if ok && g.Alive(cx, cy) {
+			padded[(x+1)>>6] |= 1 << ((x + 1) & 63)
+		}
+	}
+	if y >= 0 && y < g.Height || topology == Torus {
+		row := g.Row((y%g.Height + g.Height) % g.Height)
+		for i, word := range row {
+			padded[i] |= word << 1
+			padded[i+1] |= word >> 63
+		}
+		set(-1)
+		set(g.Width)
+		return padded
+	}
+	// Beyond the top or bottom edge the row may be dead or mirrored, so look up every cell
+	for x := -1; x <= g.Width; x++ {
+		set(x)
+	}
+	return padded
+}
+
+// paddedStride is the number of words in a row padded by one cell either side, with a word to spare so
+// that the kernel can always read the word after the one it is working on.
+func paddedStride(width int) int {
+	return (width+2+63)/64 + 1
+}
+
+// packable reports whether the rule can be evolved on packed cells: it has two states and a radius of one.
+func (r Rule) packable() bool {
+	return r.States == 2 && r.Radius == 1
+}
+
+// packedKernel evolves 64 packed cells at once, by adding up their neighbours in bit-sliced counters.
+type packedKernel struct {
+	neighbours []offset
+	birth      uint16 // Bit n is set if a dead cell with n alive neighbours is born
+	survival   uint16 // Bit n is set if an alive cell with n alive neighbours survives
+}
+
+func newPackedKernel(rule Rule) packedKernel {
+	k := packedKernel{neighbours: rule.neighbours()}
+	for n := range rule.Birth {
+		if rule.Birth[n] {
+			k.birth |= 1 << n
+		}
+		if rule.Survival[n] {
+			k.survival |= 1 << n
+		}
+	}
+	return k
+}
+
+// step evolves one row of width cells into dst, given the padded rows above, at and below it.
+func (k packedKernel) step(dst []uint64, rows [3][]uint64, width int) {
+	for i := range dst {
+		// Count each cell's alive neighbours in four bit planes, 64 cells at a time
+		var c0, c1, c2, c3 uint64
+		for _, n := range k.neighbours {
+			plane := shifted(rows[n.dy+1], i, n.dx+1)
+			carry := c0 & plane
+			c0 ^= plane
+			c1, carry = c1^carry, c1&carry
+			c2, carry = c2^carry, c2&carry
+			c3 |= carry
+		}
+
+		var born, survives uint64
+		for n := 0; n <= len(k.neighbours); n++ {
+			if (k.birth|k.survival)>>n&1 == 0 {
+				continue
+			}
+			count := match(c0, n&1) & match(c1, n>>1&1) & match(c2, n>>2&1) & match(c3, n>>3&1)
+			if k.birth>>n&1 != 0 {
+				born |= count
+			}
+			if k.survival>>n&1 != 0 {
+				survives |= count
+			}
+		}
+		alive := shifted(rows[1], i, 1)
+		dst[i] = alive&survives | ^alive&born
+	}
+	if width%64 != 0 {
+		dst[len(dst)-1] &= 1<<(width%64) - 1
+	}
+}
+
+// shifted gives the 64 bits of a packed row starting at bit 64*i + offset.
+func shifted(row []uint64, i, offset int) uint64 {
+	return row[i]>>offset | row[i+1]<<(64-offset)
+}
+
+// match gives a mask of the cells whose counter bit is the given bit.
+func match(plane uint64, bit int) uint64 {
+	if bit == 0 {
+		return ^plane
+	}
+	return plane
+}
+
+// packRow sets the bits of dst for the cells of row that are alive.
+func packRow(dst []uint64, row []byte) {
+	for x, cell := range row {
+		dst[x>>6] |= uint64(cell/255) << (x & 63)
+	}
+}
+
+// unpackRow stores the cells held in the bits of src as grey levels.
+func unpackRow(dst []byte, src []uint64) {
+	for x := range dst {
+		dst[x] = byte(src[x>>6]>>(x&63)&1) * 255
+	}
+}
+
+// nextPackedStrip evolves a strip under a packable rule, given its rows padded by one cell either side.
+func nextPackedStrip(padded [][]byte, width int, rule Rule) [][]byte {
+	packed := make([][]uint64, len(padded))
+	for i, row := range padded {
+		packed[i] = make([]uint64, paddedStride(width))
+		packRow(packed[i], row)
+	}
+
+	kernel := newPackedKernel(rule)
+	newStrip := make([][]byte, len(padded)-2)
+	dst := make([]uint64, (width+63)/64)
+	for y := range newStrip {
+		kernel.step(dst, [3][]uint64{packed[y], packed[y+1], packed[y+2]}, width)
+		newStrip[y] = make([]byte, width)
+		unpackRow(newStrip[y], dst)
+	}
+	return newStrip
+}
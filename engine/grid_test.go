@@ -0,0 +1,192 @@
+// grid_test.go
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var allTopologies = []Topology{Torus, Plane, Cylinder, KleinBottle, CrossSurface}
+
+// testRules are a two-state rule, which is evolved packed, a Generations rule and a Larger than Life rule.
+var testRules = []string{"B3/S23", "/2/3", "R2,C0,M1,S4..8,B5..7,NM"}
+
+// testSizes are widths and heights, neither of which are multiples of 64.
+var testSizes = [][2]int{{17, 23}, {130, 65}}
+
+// randomWorld makes a world in which about a third of the cells are alive and, for rules with more than
+// two states, a few more are dying.
+func randomWorld(rng *rand.Rand, height, width int, rule Rule) [][]byte {
+	world := make([][]byte, height)
+	for y := range world {
+		world[y] = make([]byte, width)
+		for x := range world[y] {
+			switch n := rng.Intn(6); {
+			case n < 2:
+				world[y][x] = 255
+			case n == 2 && rule.States > 2:
+				world[y][x] = rule.Grey(2 + rng.Intn(rule.States-2))
+			}
+		}
+	}
+	return world
+}
+
+// referenceNext evolves the world one cell at a time, finding each neighbour through the topology,
+// as the simplest statement of what every engine should compute.
+func referenceNext(world [][]byte, height, width int, rule Rule, topology Topology) [][]byte {
+	next := make([][]byte, height)
+	for y := range next {
+		next[y] = make([]byte, width)
+		for x := range next[y] {
+			alive := 0
+			for _, n := range rule.neighbours() {
+				nx, ny, ok := topology.locate(x+n.dx, y+n.dy, width, height)
+				if ok && world[ny][nx] == 255 {
+					alive++
+				}
+			}
+			next[y][x] = rule.Next(world[y][x], alive)
+		}
+	}
+	return next
+}
+
+// nextInStrips evolves the world as the workers do, in strips with halo rows borrowed from their
+// neighbours and only the side columns they need.
+func nextInStrips(world [][]byte, height, width, strips int, rule Rule, topology Topology) [][]byte {
+	var next [][]byte
+	for i := 0; i < strips; i++ {
+		startY, endY := i*height/strips, (i+1)*height/strips
+		var strip [][]byte
+		for y := startY - rule.Radius; y < endY+rule.Radius; y++ {
+			strip = append(strip, world[(y%height+height)%height])
+		}
+		next = append(next, NextStrip(strip, startY, height, width, rule, topology, stripSides(world, startY, endY, rule, topology))...)
+	}
+	return next
+}
+
+// stripSides gives the side columns of the rows of the world a strip needs, as the server sends them,
+// leaving the rest out so that using them fails.
+func stripSides(world [][]byte, startY, endY int, rule Rule, topology Topology) [][]byte {
+	if !topology.NeedsSides() {
+		return nil
+	}
+	all := SideColumns(world, rule.Radius)
+	sides := make([][]byte, len(world))
+	from, n := SidesNeeded(startY, endY, len(world), rule.Radius)
+	for i := 0; i < n; i++ {
+		y := (from + i) % len(world)
+		sides[y] = all[y]
+	}
+	return sides
+}
+
+// firstDifference describes the first cell at which two worlds differ, or gives "" if they are the same.
+func firstDifference(got, want [][]byte) string {
+	if len(got) != len(want) {
+		return fmt.Sprintf("height %v, expected %v", len(got), len(want))
+	}
+	for y := range want {
+		if len(got[y]) != len(want[y]) {
+			return fmt.Sprintf("row %v has width %v, expected %v", y, len(got[y]), len(want[y]))
+		}
+		for x := range want[y] {
+			if got[y][x] != want[y][x] {
+				return fmt.Sprintf("cell (%v, %v) is %v, expected %v", x, y, got[y][x], want[y][x])
+			}
+		}
+	}
+	return ""
+}
+
+// forEachCase runs a subtest for every combination of rule, topology and size.
+func forEachCase(t *testing.T, sizes [][2]int, test func(t *testing.T, rule Rule, topology Topology, width, height int)) {
+	for _, s := range testRules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, topology := range allTopologies {
+			for _, size := range sizes {
+				name := fmt.Sprintf("%v/%v/%dx%d", s, topology, size[0], size[1])
+				t.Run(name, func(t *testing.T) {
+					test(t, rule, topology, size[0], size[1])
+				})
+			}
+		}
+	}
+}
+
+// TestNextWorld tests whole-world evolution against the reference.
+func TestNextWorld(t *testing.T) {
+	forEachCase(t, testSizes, func(t *testing.T, rule Rule, topology Topology, width, height int) {
+		world := randomWorld(rand.New(rand.NewSource(1)), height, width, rule)
+		for turn := 1; turn <= 4; turn++ {
+			want := referenceNext(world, height, width, rule, topology)
+			if diff := firstDifference(NextWorld(world, height, width, rule, topology), want); diff != "" {
+				t.Fatalf("turn %v: %v", turn, diff)
+			}
+			world = want
+		}
+	})
+}
+
+// TestNextStrip tests that evolving the world in strips of various heights gives the same as the reference.
+func TestNextStrip(t *testing.T) {
+	forEachCase(t, testSizes, func(t *testing.T, rule Rule, topology Topology, width, height int) {
+		world := randomWorld(rand.New(rand.NewSource(2)), height, width, rule)
+		for turn := 1; turn <= 3; turn++ {
+			want := referenceNext(world, height, width, rule, topology)
+			for _, strips := range []int{1, 2, 3, 7} {
+				if diff := firstDifference(nextInStrips(world, height, width, strips, rule, topology), want); diff != "" {
+					t.Fatalf("turn %v in %v strips: %v", turn, strips, diff)
+				}
+			}
+			world = want
+		}
+	})
+}
+
+// TestGridNext tests the bit-packed grid against the reference. Grids only hold two-state worlds, so
+// Generations rules are left out.
+func TestGridNext(t *testing.T) {
+	forEachCase(t, testSizes, func(t *testing.T, rule Rule, topology Topology, width, height int) {
+		if rule.States > 2 {
+			t.Skip("grids only hold two states")
+		}
+		world := randomWorld(rand.New(rand.NewSource(3)), height, width, rule)
+		grid := PackGrid(world, height, width)
+		for turn := 1; turn <= 4; turn++ {
+			world = referenceNext(world, height, width, rule, topology)
+			grid = grid.Next(rule, topology)
+			if diff := firstDifference(grid.Unpack(), world); diff != "" {
+				t.Fatalf("turn %v: %v", turn, diff)
+			}
+			if grid.CountAlive() != CountAliveCells(world) {
+				t.Fatalf("turn %v: %v alive, expected %v", turn, grid.CountAlive(), CountAliveCells(world))
+			}
+		}
+	})
+}
+
+// TestPackGrid tests that packing and unpacking keep every cell, including those in the last partial word.
+func TestPackGrid(t *testing.T) {
+	rule, _ := ParseRule(DefaultRule)
+	for _, size := range append(testSizes, [2]int{64, 3}, [2]int{65, 2}, [2]int{1, 1}) {
+		width, height := size[0], size[1]
+		world := randomWorld(rand.New(rand.NewSource(4)), height, width, rule)
+		grid := PackGrid(world, height, width)
+		if diff := firstDifference(grid.Unpack(), world); diff != "" {
+			t.Errorf("%dx%d: %v", width, height, diff)
+		}
+		if diff := firstDifference(GridFromWords(grid.Words(), height, width).Unpack(), world); diff != "" {
+			t.Errorf("%dx%d from words: %v", width, height, diff)
+		}
+		if len(grid.AliveCells()) != CountAliveCells(world) {
+			t.Errorf("%dx%d: %v alive cells listed, expected %v", width, height, len(grid.AliveCells()), CountAliveCells(world))
+		}
+	}
+}
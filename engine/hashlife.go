@@ -0,0 +1,276 @@
+// hashlife.go
+package engine
+
+import "fmt"
+
+const (
+	maxNodes      = 1 << 22 // Quadtree nodes HashLife keeps before clearing out the ones it no longer needs
+	maxPopulation = 1 << 60 // Populations of the huge tilings HashLife builds are capped here rather than overflowing
+)
+
+// node is a square of 2^level by 2^level cells in HashLife's quadtree. Nodes are shared: there is only
+// ever one node for each arrangement of cells, so a node can remember what it evolves into.
+type node struct {
+	nw, ne, sw, se *node
+	level          int
+	population     int
+	next           []*node // next[j] is the centre of the node after 2^j turns, once worked out
+}
+
+type quadrants struct {
+	nw, ne, sw, se *node
+}
+
+// HashLife evolves a world with Gosper's HashLife algorithm, which stores the world as a quadtree of
+// shared nodes and remembers how every node evolves. Worlds that settle down or repeat can then be
+// moved on by billions of turns in a few steps, each jumping a power of two turns at once.
+//
+// HashLife works on two-state rules with a radius of one, on a torus whose sides are powers of two.
+type HashLife struct {
+	rule       Rule
+	neighbours []offset
+	width      int
+	height     int
+	root       *node // The world tiled out to a square
+	nodes      map[quadrants]*node
+	dead       []*node // The node of dead cells at each level
+	alive      *node   // The single alive cell
+}
+
+// NewHashLife loads a world into a HashLife engine, or explains why the engine cannot evolve it.
+func NewHashLife(world [][]byte, height, width int, rule Rule, topology Topology) (*HashLife, error) {
+	switch {
+	case !rule.packable():
+		return nil, fmt.Errorf("HashLife needs a two-state rule with a radius of one, not %v", rule)
+	case topology != Torus:
+		return nil, fmt.Errorf("HashLife needs a torus, not a %v", topology)
+	case !powerOfTwo(width) || !powerOfTwo(height):
+		return nil, fmt.Errorf("HashLife needs sides that are powers of two, not %dx%d", width, height)
+	}
+	h := &HashLife{rule: rule, neighbours: rule.neighbours(), width: width, height: height}
+	h.load(world)
+	return h, nil
+}
+
+func powerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// load clears out every node and builds the quadtree for the world afresh. A world that is not square
+// is tiled out to one, which on a torus evolves just the same.
+func (h *HashLife) load(world [][]byte) {
+	h.nodes = make(map[quadrants]*node)
+	h.dead = []*node{{level: 0}}
+	h.alive = &node{level: 0, population: 1}
+	level := 0
+	for 1<<level < h.width || 1<<level < h.height {
+		level++
+	}
+	h.root = h.build(world, 0, 0, level)
+}
+
+// build makes the node for the square of the world at (x, y) with sides of 2^level.
+func (h *HashLife) build(world [][]byte, x, y, level int) *node {
+	if level == 0 {
+		if world[y%h.height][x%h.width] == 255 {
+			return h.alive
+		}
+		return h.dead[0]
+	}
+	half := 1 << (level - 1)
+	return h.join(
+		h.build(world, x, y, level-1), h.build(world, x+half, y, level-1),
+		h.build(world, x, y+half, level-1), h.build(world, x+half, y+half, level-1))
+}
+
+// join gives the node made of four nodes a level down.
+func (h *HashLife) join(nw, ne, sw, se *node) *node {
+	key := quadrants{nw, ne, sw, se}
+	if n, ok := h.nodes[key]; ok {
+		return n
+	}
+	n := &node{
+		nw: nw, ne: ne, sw: sw, se: se,
+		level:      nw.level + 1,
+		population: nw.population + ne.population + sw.population + se.population,
+	}
+	if n.population > maxPopulation {
+		n.population = maxPopulation
+	}
+	h.nodes[key] = n
+	return n
+}
+
+// centre gives the middle half of a node.
+func (h *HashLife) centre(n *node) *node {
+	return h.join(n.nw.se, n.ne.sw, n.sw.ne, n.se.nw)
+}
+
+// advance gives the centre of a node after 2^j turns, where j is at most the node's level less two,
+// so that nothing from outside the node can reach the centre in that time.
+func (h *HashLife) advance(n *node, j int) *node {
+	if n.population == 0 {
+		return h.deadNode(n.level - 1)
+	}
+	if j < len(n.next) && n.next[j] != nil {
+		return n.next[j]
+	}
+
+	var result *node
+	if n.level == 2 {
+		result = h.base(n)
+	} else {
+		// The nine overlapping squares half the size of the node
+		n00, n01, n02 := n.nw, h.join(n.nw.ne, n.ne.nw, n.nw.se, n.ne.sw), n.ne
+		n10 := h.join(n.nw.sw, n.nw.se, n.sw.nw, n.sw.ne)
+		n11 := h.join(n.nw.se, n.ne.sw, n.sw.ne, n.se.nw)
+		n12 := h.join(n.ne.sw, n.ne.se, n.se.nw, n.se.ne)
+		n20, n21, n22 := n.sw, h.join(n.sw.ne, n.se.nw, n.sw.se, n.se.sw), n.se
+
+		if j == n.level-2 {
+			// Go half the way in each square, then the other half in the four squares they make up
+			half := j - 1
+			a00, a01, a02 := h.advance(n00, half), h.advance(n01, half), h.advance(n02, half)
+			a10, a11, a12 := h.advance(n10, half), h.advance(n11, half), h.advance(n12, half)
+			a20, a21, a22 := h.advance(n20, half), h.advance(n21, half), h.advance(n22, half)
+			result = h.join(
+				h.advance(h.join(a00, a01, a10, a11), half), h.advance(h.join(a01, a02, a11, a12), half),
+				h.advance(h.join(a10, a11, a20, a21), half), h.advance(h.join(a11, a12, a21, a22), half))
+		} else {
+			// Short jumps only need the centres of the nine squares
+			c00, c01, c02 := h.centre(n00), h.centre(n01), h.centre(n02)
+			c10, c11, c12 := h.centre(n10), h.centre(n11), h.centre(n12)
+			c20, c21, c22 := h.centre(n20), h.centre(n21), h.centre(n22)
+			result = h.join(
+				h.advance(h.join(c00, c01, c10, c11), j), h.advance(h.join(c01, c02, c11, c12), j),
+				h.advance(h.join(c10, c11, c20, c21), j), h.advance(h.join(c11, c12, c21, c22), j))
+		}
+	}
+
+	if len(n.next) <= j {
+		next := make([]*node, j+1)
+		copy(next, n.next)
+		n.next = next
+	}
+	n.next[j] = result
+	return result
+}
+
+// base works out the centre two by two cells of a four by four node after one turn, by applying the rule.
+func (h *HashLife) base(n *node) *node {
+	var cells [4][4]bool
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			cells[y][x] = cellAt(n, x, y)
+		}
+	}
+	var centre [4]*node
+	for i := range centre {
+		x, y := 1+i%2, 1+i/2
+		count := 0
+		for _, o := range h.neighbours {
+			if cells[y+o.dy][x+o.dx] {
+				count++
+			}
+		}
+		grey := byte(0)
+		if cells[y][x] {
+			grey = 255
+		}
+		centre[i] = h.dead[0]
+		if h.rule.Next(grey, count) == 255 {
+			centre[i] = h.alive
+		}
+	}
+	return h.join(centre[0], centre[1], centre[2], centre[3])
+}
+
+// cellAt reports whether the cell at (x, y) of a node is alive.
+func cellAt(n *node, x, y int) bool {
+	for n.level > 0 {
+		half := 1 << (n.level - 1)
+		switch {
+		case x < half && y < half:
+			n = n.nw
+		case y < half:
+			n, x = n.ne, x-half
+		case x < half:
+			n, y = n.sw, y-half
+		default:
+			n, x, y = n.se, x-half, y-half
+		}
+	}
+	return n.population == 1
+}
+
+// Replace swaps in another world of the same size, keeping the nodes the engine has already worked out
+// the evolution of.
+func (h *HashLife) Replace(world [][]byte) {
+	h.root = h.build(world, 0, 0, h.root.level)
+}
+
+// deadNode gives the node of dead cells at a level.
+func (h *HashLife) deadNode(level int) *node {
+	for len(h.dead) <= level {
+		d := h.dead[len(h.dead)-1]
+		h.dead = append(h.dead, h.join(d, d, d, d))
+	}
+	return h.dead[level]
+}
+
+// Step moves the world on by 2^k turns.
+func (h *HashLife) Step(k int) {
+	// Tile the world out far enough that the centre of the tiling is a whole number of worlds in from
+	// its corner and nothing from beyond the tiling reaches it in time. The tiling repeats the world,
+	// so it evolves exactly as the torus does.
+	level := h.root.level
+	m := k - level + 1
+	if m < 1 {
+		m = 1
+	}
+	tiling := h.root
+	for i := 0; i <= m; i++ {
+		tiling = h.join(tiling, tiling, tiling, tiling)
+	}
+	result := h.advance(tiling, k)
+	for i := 0; i < m; i++ {
+		result = result.nw
+	}
+	h.root = result
+
+	if len(h.nodes) > maxNodes {
+		h.load(h.World())
+	}
+}
+
+// World gives the world as of the last step.
+func (h *HashLife) World() [][]byte {
+	world := make([][]byte, h.height)
+	for y := range world {
+		world[y] = make([]byte, h.width)
+	}
+	h.fill(world, h.root, 0, 0)
+	return world
+}
+
+// fill sets the cells of the world covered by a node at (x, y).
+func (h *HashLife) fill(world [][]byte, n *node, x, y int) {
+	if n.population == 0 || x >= h.width || y >= h.height {
+		return
+	}
+	if n.level == 0 {
+		world[y][x] = 255
+		return
+	}
+	half := 1 << (n.level - 1)
+	h.fill(world, n.nw, x, y)
+	h.fill(world, n.ne, x+half, y)
+	h.fill(world, n.sw, x, y+half)
+	h.fill(world, n.se, x+half, y+half)
+}
+
+// CountAlive counts the alive cells in the world.
+func (h *HashLife) CountAlive() int {
+	size := 1 << h.root.level
+	return h.root.population / ((size / h.width) * (size / h.height))
+}
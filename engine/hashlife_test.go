@@ -0,0 +1,92 @@
+// hashlife_test.go
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestHashLifeStep tests jumps of 2^k turns against evolving the world one turn at a time, on square
+// worlds and on worlds HashLife has to tile out to a square.
+func TestHashLifeStep(t *testing.T) {
+	for _, s := range []string{"B3/S23", "B36/S23"} {
+		rule, _ := ParseRule(s)
+		for _, size := range [][2]int{{16, 16}, {32, 32}, {64, 16}, {8, 32}, {1, 4}} {
+			width, height := size[0], size[1]
+			for k := 0; k <= 7; k++ {
+				t.Run(fmt.Sprintf("%v/%dx%d/2^%d", s, width, height, k), func(t *testing.T) {
+					world := randomWorld(rand.New(rand.NewSource(int64(k))), height, width, rule)
+					h, err := NewHashLife(world, height, width, rule, Torus)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for turn := 0; turn < 1<<k; turn++ {
+						world = NextWorld(world, height, width, rule, Torus)
+					}
+					h.Step(k)
+					if diff := firstDifference(h.World(), world); diff != "" {
+						t.Fatal(diff)
+					}
+					if h.CountAlive() != CountAliveCells(world) {
+						t.Fatalf("%v alive, expected %v", h.CountAlive(), CountAliveCells(world))
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestHashLifeSteps tests a run of steps of different sizes, which reuse the nodes worked out before,
+// with the world replaced part way through.
+func TestHashLifeSteps(t *testing.T) {
+	rule, _ := ParseRule(DefaultRule)
+	width, height := 32, 64
+	rng := rand.New(rand.NewSource(5))
+	world := randomWorld(rng, height, width, rule)
+	h, err := NewHashLife(world, height, width, rule, Torus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn := 0
+	for i, k := range []int{3, 0, 5, 1, 7, 2, 6, 4} {
+		if i == 4 {
+			world = randomWorld(rng, height, width, rule)
+			h.Replace(world)
+		}
+		for j := 0; j < 1<<k; j++ {
+			world = NextWorld(world, height, width, rule, Torus)
+		}
+		h.Step(k)
+		turn += 1 << k
+		if diff := firstDifference(h.World(), world); diff != "" {
+			t.Fatalf("turn %v: %v", turn, diff)
+		}
+		if h.CountAlive() != CountAliveCells(world) {
+			t.Fatalf("turn %v: %v alive, expected %v", turn, h.CountAlive(), CountAliveCells(world))
+		}
+	}
+}
+
+// TestNewHashLife tests that worlds HashLife cannot evolve are refused.
+func TestNewHashLife(t *testing.T) {
+	tests := []struct {
+		rule          string
+		topology      Topology
+		width, height int
+	}{
+		{"/2/3", Torus, 16, 16},
+		{"R2,C0,M1,S4..8,B5..7,NM", Torus, 16, 16},
+		{"B3/S23", Plane, 16, 16},
+		{"B3/S23", KleinBottle, 16, 16},
+		{"B3/S23", Torus, 17, 16},
+		{"B3/S23", Torus, 16, 48},
+	}
+	for _, test := range tests {
+		rule, _ := ParseRule(test.rule)
+		world := randomWorld(rand.New(rand.NewSource(6)), test.height, test.width, rule)
+		if _, err := NewHashLife(world, test.height, test.width, rule, test.topology); err == nil {
+			t.Errorf("%v on a %dx%d %v was accepted", test.rule, test.width, test.height, test.topology)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// rule.go
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultRule is Conway's Game of Life, used when no rule set is given.
+const DefaultRule = "B3/S23"
+
+// Neighbourhood is the shape of the area around a cell whose alive cells count as its neighbours.
+type Neighbourhood int
+
+const (
+	Moore      Neighbourhood = iota // The square of cells within Radius in both directions
+	VonNeumann                      // The diamond of cells within Radius steps horizontally plus vertically
+	Hexagonal                       // A hexagon, emulated on the square grid by leaving out two opposite corners
+)
+
+// Rule is a rule set: the numbers of alive neighbours for which a dead cell is born and for which an
+// alive cell survives. Rules with more than two States are "Generations" rules, in which a cell that
+// does not survive passes through States-2 dying states before it is dead. Rules with a Radius greater
+// than one are "Larger than Life" rules.
+//
+// Cells are stored as grey levels: 255 is alive, 0 is dead and the dying states are the levels
+// in between, getting darker as the cell decays.
+type Rule struct {
+	Birth         []bool // Indexed by number of alive neighbours
+	Survival      []bool // Indexed by number of alive neighbours
+	States        int
+	Radius        int
+	Neighbourhood Neighbourhood
+	Middle        bool // Whether a cell counts itself as one of its neighbours
+}
+
+// offset is the position of a neighbour relative to a cell
+type offset struct {
+	dx, dy int
+}
+
+// neighbours lists the positions relative to a cell that make up its neighbourhood.
+func (r Rule) neighbours() []offset {
+	var offsets []offset
+	for dy := -r.Radius; dy <= r.Radius; dy++ {
+		for dx := -r.Radius; dx <= r.Radius; dx++ {
+			if dx == 0 && dy == 0 && !r.Middle {
+				continue // Skip the cell itself
+			}
+			switch r.Neighbourhood {
+			case VonNeumann:
+				if abs(dx)+abs(dy) > r.Radius {
+					continue
+				}
+			case Hexagonal:
+				if abs(dx-dy) > r.Radius {
+					continue
+				}
+			}
+			offsets = append(offsets, offset{dx, dy})
+		}
+	}
+	return offsets
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// ParseRule reads a rule set. Life-like rules are given in Birth/Survival notation, such as "B3/S23"
+// (Conway), "B36/S23" (HighLife) or "B2/S" (Seeds), optionally followed by H or V for the hexagonal or
+// von Neumann neighbourhood, or in the older Survival/Birth form of pattern files, such as "23/3".
+// Generations rules add the number of states, either as "B2/S/C3" or in Survival/Birth/States form,
+// such as "/2/3" (Brian's Brain) or "345/2/4" (Star Wars). Larger than Life rules are given as
+// "R5,C0,M1,S34..58,B34..45,NM" (Bosco's rule): the radius, number of states, whether the middle cell
+// counts itself, the survival and birth ranges and the neighbourhood, which is NM for Moore, NN for
+// von Neumann or NH for hexagonal. An empty string gives DefaultRule.
+func ParseRule(s string) (Rule, error) {
+	if s == "" {
+		s = DefaultRule
+	}
+	text := strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasPrefix(text, "R") {
+		return parseLargerThanLife(s, text)
+	}
+	return parseLifeLike(s, text)
+}
+
+// parseLifeLike reads a rule set in Birth/Survival, Survival/Birth or Survival/Birth/States notation.
+func parseLifeLike(s, text string) (Rule, error) {
+	rule := Rule{States: 2, Radius: 1}
+	invalid := fmt.Errorf("invalid rule %q: expected B.../S..., S/B/C or R...,C...,M...,S...,B...,N...", s)
+	switch {
+	case strings.HasSuffix(text, "H"):
+		rule.Neighbourhood = Hexagonal
+		text = strings.TrimSuffix(text, "H")
+	case strings.HasSuffix(text, "V"):
+		rule.Neighbourhood = VonNeumann
+		text = strings.TrimSuffix(text, "V")
+	}
+	maxCount := len(rule.neighbours())
+	rule.Birth = make([]bool, maxCount+1)
+	rule.Survival = make([]bool, maxCount+1)
+
+	parts := strings.Split(text, "/")
+	switch {
+	case len(parts) == 3 && isDigits(parts[0]) && isDigits(parts[1]) && isDigits(parts[2]):
+		// Survival/Birth/States
+		parts = []string{"S" + parts[0], "B" + parts[1], "C" + parts[2]}
+	case len(parts) == 2 && isDigits(parts[0]) && isDigits(parts[1]):
+		// Survival/Birth, as older pattern files give rules
+		parts = []string{"S" + parts[0], "B" + parts[1]}
+	}
+	if len(parts) != 2 && len(parts) != 3 {
+		return rule, invalid
+	}
+
+	seen := make(map[byte]bool)
+	for _, part := range parts {
+		if part == "" || seen[part[0]] {
+			return rule, invalid
+		}
+		seen[part[0]] = true
+
+		var counts []bool
+		switch part[0] {
+		case 'B':
+			counts = rule.Birth
+		case 'S':
+			counts = rule.Survival
+		case 'C', 'G':
+			states, err := strconv.Atoi(part[1:])
+			if err != nil || states < 2 || states > 256 {
+				return rule, fmt.Errorf("invalid rule %q: number of states must be between 2 and 256", s)
+			}
+			rule.States = states
+			continue
+		default:
+			return rule, invalid
+		}
+		for _, c := range part[1:] {
+			if c < '0' || int(c-'0') > maxCount {
+				return rule, fmt.Errorf("invalid rule %q: %q is not a neighbour count", s, c)
+			}
+			counts[c-'0'] = true
+		}
+	}
+	if !seen['B'] || !seen['S'] {
+		return rule, invalid
+	}
+	return rule, nil
+}
+
+// parseLargerThanLife reads a rule set in Larger than Life notation.
+func parseLargerThanLife(s, text string) (Rule, error) {
+	rule := Rule{States: 2}
+	invalid := fmt.Errorf("invalid rule %q: expected R...,C...,M...,S...,B...,N...", s)
+	var birth, survival [2]int
+	seen := make(map[byte]bool)
+	for _, part := range strings.Split(text, ",") {
+		if part == "" || seen[part[0]] {
+			return rule, invalid
+		}
+		seen[part[0]] = true
+
+		value := part[1:]
+		var err error
+		switch part[0] {
+		case 'R':
+			rule.Radius, err = strconv.Atoi(value)
+			if err == nil && (rule.Radius < 1 || rule.Radius > 500) {
+				return rule, fmt.Errorf("invalid rule %q: radius must be between 1 and 500", s)
+			}
+		case 'C':
+			rule.States, err = strconv.Atoi(value)
+			if rule.States == 0 {
+				rule.States = 2
+			}
+			if err == nil && (rule.States < 2 || rule.States > 256) {
+				return rule, fmt.Errorf("invalid rule %q: number of states must be between 2 and 256", s)
+			}
+		case 'M':
+			switch value {
+			case "0":
+			case "1":
+				rule.Middle = true
+			default:
+				return rule, invalid
+			}
+		case 'S':
+			survival, err = parseRange(value)
+		case 'B':
+			birth, err = parseRange(value)
+		case 'N':
+			switch value {
+			case "M":
+				rule.Neighbourhood = Moore
+			case "N":
+				rule.Neighbourhood = VonNeumann
+			case "H":
+				rule.Neighbourhood = Hexagonal
+			default:
+				return rule, fmt.Errorf("invalid rule %q: unknown neighbourhood N%v", s, value)
+			}
+		default:
+			return rule, invalid
+		}
+		if err != nil {
+			return rule, invalid
+		}
+	}
+	if !seen['R'] || !seen['B'] || !seen['S'] {
+		return rule, invalid
+	}
+
+	maxCount := len(rule.neighbours())
+	rule.Birth = make([]bool, maxCount+1)
+	rule.Survival = make([]bool, maxCount+1)
+	for n := 0; n <= maxCount; n++ {
+		rule.Birth[n] = n >= birth[0] && n <= birth[1]
+		rule.Survival[n] = n >= survival[0] && n <= survival[1]
+	}
+	return rule, nil
+}
+
+// parseRange reads an inclusive range of neighbour counts written as "min..max".
+func parseRange(s string) ([2]int, error) {
+	var r [2]int
+	bounds := strings.Split(s, "..")
+	if len(bounds) != 2 {
+		return r, fmt.Errorf("invalid range %q", s)
+	}
+	for i, bound := range bounds {
+		n, err := strconv.Atoi(bound)
+		if err != nil {
+			return r, err
+		}
+		r[i] = n
+	}
+	return r, nil
+}
+
+// isDigits reports whether s consists only of decimal digits.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String gives the rule in canonical notation, which ParseRule reads back as the same rule.
+func (r Rule) String() string {
+	var b strings.Builder
+	if r.Radius == 1 && !r.Middle {
+		b.WriteString("B")
+		for n, born := range r.Birth {
+			if born {
+				fmt.Fprint(&b, n)
+			}
+		}
+		b.WriteString("/S")
+		for n, survives := range r.Survival {
+			if survives {
+				fmt.Fprint(&b, n)
+			}
+		}
+		if r.States > 2 {
+			fmt.Fprintf(&b, "/C%d", r.States)
+		}
+		switch r.Neighbourhood {
+		case VonNeumann:
+			b.WriteString("V")
+		case Hexagonal:
+			b.WriteString("H")
+		}
+		return b.String()
+	}
+
+	middle := 0
+	if r.Middle {
+		middle = 1
+	}
+	states := r.States
+	if states == 2 {
+		states = 0
+	}
+	survival, birth := countRange(r.Survival), countRange(r.Birth)
+	fmt.Fprintf(&b, "R%d,C%d,M%d,S%d..%d,B%d..%d,N%c",
+		r.Radius, states, middle, survival[0], survival[1], birth[0], birth[1], "MNH"[r.Neighbourhood])
+	return b.String()
+}
+
+// countRange gives the smallest and largest neighbour count set in counts, or an empty range if none are.
+func countRange(counts []bool) [2]int {
+	r := [2]int{1, 0}
+	for n, set := range counts {
+		if set {
+			if r[0] > r[1] {
+				r[0] = n
+			}
+			r[1] = n
+		}
+	}
+	return r
+}
+
+// Grey gives the grey level a cell in the given state is stored as, where state 0 is dead,
+// state 1 is alive and each later state is one step further decayed.
+func (r Rule) Grey(state int) byte {
+	if state <= 0 || state >= r.States {
+		return 0
+	}
+	return byte(255 * (r.States - state) / (r.States - 1))
+}
+
+// State gives the state a cell stored with the given grey level is in, rounding to the nearest
+// dying state. For two-state rules only 255 is alive.
+func (r Rule) State(grey byte) int {
+	switch {
+	case grey == 255:
+		return 1
+	case grey == 0 || r.States <= 2:
+		return 0
+	}
+	state := r.States - (int(grey)*(r.States-1)+127)/255
+	if state < 2 {
+		state = 2
+	}
+	return state
+}
+
+// Next gives the grey level of a cell in the next turn, given its current grey level and its
+// number of alive neighbours.
+func (r Rule) Next(grey byte, aliveNeighbors int) byte {
+	switch r.State(grey) {
+	case 0:
+		if r.Birth[aliveNeighbors] {
+			return 255 // Becomes alive
+		}
+		return 0 // Stays dead
+	case 1:
+		if r.Survival[aliveNeighbors] {
+			return 255 // Stays alive
+		}
+		return r.Grey(2) // Starts to die, or dies
+	default:
+		return r.Grey(r.State(grey) + 1) // Decays further
+	}
+}
@@ -0,0 +1,131 @@
+// rule_test.go
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseRule tests rules in each notation, checking that they read as what String gives back.
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule          string
+		canonical     string
+		states        int
+		radius        int
+		neighbourhood Neighbourhood
+		neighbours    int
+	}{
+		{"", "B3/S23", 2, 1, Moore, 8},
+		{"B3/S23", "B3/S23", 2, 1, Moore, 8},
+		{"b36/s23", "B36/S23", 2, 1, Moore, 8},
+		{"S23/B3", "B3/S23", 2, 1, Moore, 8},
+		{"B2/S", "B2/S", 2, 1, Moore, 8},
+		{"23/3", "B3/S23", 2, 1, Moore, 8},
+		{"B2/S/C3", "B2/S/C3", 3, 1, Moore, 8},
+		{"B3/S23/G5", "B3/S23/C5", 5, 1, Moore, 8},
+		{"/2/3", "B2/S/C3", 3, 1, Moore, 8},
+		{"345/2/4", "B2/S345/C4", 4, 1, Moore, 8},
+		{"B2/S34H", "B2/S34H", 2, 1, Hexagonal, 6},
+		{"B2/S13V", "B2/S13V", 2, 1, VonNeumann, 4},
+		{"R5,C0,M1,S34..58,B34..45,NM", "R5,C0,M1,S34..58,B34..45,NM", 2, 5, Moore, 121},
+		{"R2,C3,M0,S1..4,B2..3,NN", "R2,C3,M0,S1..4,B2..3,NN", 3, 2, VonNeumann, 12},
+		{"R3,C0,M0,S2..9,B3..3,NH", "R3,C0,M0,S2..9,B3..3,NH", 2, 3, Hexagonal, 36},
+		{"r1,c0,m0,s2..3,b3..3,nm", "B3/S23", 2, 1, Moore, 8},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.rule)
+		if err != nil {
+			t.Errorf("%q: %v", test.rule, err)
+			continue
+		}
+		if rule.String() != test.canonical {
+			t.Errorf("%q reads as %q, expected %q", test.rule, rule.String(), test.canonical)
+		}
+		if rule.States != test.states || rule.Radius != test.radius || rule.Neighbourhood != test.neighbourhood {
+			t.Errorf("%q has %v states, radius %v and neighbourhood %v, expected %v, %v and %v", test.rule,
+				rule.States, rule.Radius, rule.Neighbourhood, test.states, test.radius, test.neighbourhood)
+		}
+		if n := len(rule.neighbours()); n != test.neighbours {
+			t.Errorf("%q has %v neighbours, expected %v", test.rule, n, test.neighbours)
+		}
+
+		again, err := ParseRule(rule.String())
+		if err != nil {
+			t.Errorf("%q does not read back: %v", rule.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(again, rule) {
+			t.Errorf("%q reads back as %+v, expected %+v", rule.String(), again, rule)
+		}
+	}
+}
+
+// TestParseRuleInvalid tests that malformed rules are refused.
+func TestParseRuleInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"B3", "B3/B3", "X3/S23", "B3/S23/C3/C4", "B3/S2a",
+		"B9/S23", "B7/S23H", "B5/S23V",
+		"B3/S23/C1", "B3/S23/C257", "2/3/1",
+		"R0,C0,M0,S1..2,B1..2,NM", "R501,C0,M0,S1..2,B1..2,NM", "R2,C0,M2,S1..2,B1..2,NM",
+		"R2,C0,M0,S1..2,NM", "R2,C0,M0,S1..2,B1..2,NQ", "R2,C0,M0,S1-2,B1..2,NM", "R2,R3,S1..2,B1..2",
+	} {
+		if _, err := ParseRule(rule); err == nil {
+			t.Errorf("%q was accepted", rule)
+		}
+	}
+}
+
+// TestRuleGrey tests that every state is stored as a grey level that reads back as the same state.
+func TestRuleGrey(t *testing.T) {
+	for _, s := range []string{"B3/S23", "/2/3", "345/2/4", "B3/S23/C256"} {
+		rule, _ := ParseRule(s)
+		if rule.Grey(0) != 0 || rule.Grey(1) != 255 {
+			t.Errorf("%v: dead is %v and alive is %v", s, rule.Grey(0), rule.Grey(1))
+		}
+		last := 256
+		for state := 0; state < rule.States; state++ {
+			grey := rule.Grey(state)
+			if got := rule.State(grey); got != state {
+				t.Errorf("%v: state %v is stored as %v, which reads as state %v", s, state, grey, got)
+			}
+			if state > 1 && int(grey) >= last {
+				t.Errorf("%v: state %v is no darker than the state before", s, state)
+			}
+			if state > 0 {
+				last = int(grey)
+			}
+		}
+	}
+}
+
+// TestRuleNext tests the transitions of a two-state and a Generations rule.
+func TestRuleNext(t *testing.T) {
+	life, _ := ParseRule("B3/S23")
+	brain, _ := ParseRule("/2/3")
+	dying := brain.Grey(2)
+	tests := []struct {
+		rule       Rule
+		grey       byte
+		neighbours int
+		want       byte
+	}{
+		{life, 0, 3, 255},
+		{life, 0, 2, 0},
+		{life, 255, 2, 255},
+		{life, 255, 3, 255},
+		{life, 255, 4, 0},
+		{life, 255, 1, 0},
+		// Cells of two-state rules at any level but 255 are dead
+		{life, 128, 3, 255},
+		{brain, 0, 2, 255},
+		{brain, 0, 3, 0},
+		{brain, 255, 2, dying},
+		{brain, dying, 2, 0},
+	}
+	for _, test := range tests {
+		if got := test.rule.Next(test.grey, test.neighbours); got != test.want {
+			t.Errorf("%v: %v with %v neighbours becomes %v, expected %v", test.rule, test.grey, test.neighbours, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// sparse.go
+package engine
+
+import (
+	"math/bits"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TileSize is the width and height in cells of the tiles Sparse divides a strip into. A row of a tile
+// packs into a single word.
+const TileSize = 64
+
+// Sparse evolves a strip of the world while skipping the areas that have settled down. The strip is
+// divided into tiles, and only the tiles near a cell that changed in the last turn, or near a change to
+// the halo rows or side columns, are worked out again; the rest cannot have changed. Worlds in which
+// most of the cells are still or empty then take a fraction of the time to evolve.
+type Sparse struct {
+	rule     Rule
+	topology Topology
+	offsets  []int // Offsets of the neighbours from a cell in cells
+	startY   int   // Row of the world the strip starts at
+	height   int   // Height of the whole world
+	width    int
+	rows     int // Height of the strip
+	r        int // Radius of the rule
+	stride   int
+
+	// The strip with its halo rows above and below and its side columns either side, one row
+	// after another, so that neighbours can be counted without wrapping
+	cells   []byte
+	scratch []byte
+
+	kernel *packedKernel // Kernel for rules that can be evolved on packed cells, or nil
+	packed [][]uint64    // The rows of the tile being worked out, packed, with a row and column either side
+
+	tilesX, tilesY int
+	active         []bool // Tiles to work out in the next step
+	touched        []bool // Tiles with a cell that changed in the last step
+	alive          int
+
+	changed  []util.Cell // Cells that changed in the last step
+	greys    []byte      // Grey levels they changed to
+	boundary [2]bool     // Whether the top and bottom rows changed in the last step
+}
+
+// NewSparse loads a strip of the world starting at row startY. Every tile is worked out in the first step.
+func NewSparse(strip [][]byte, startY, height, width int, rule Rule, topology Topology) *Sparse {
+	r := rule.Radius
+	s := &Sparse{
+		rule:     rule,
+		topology: topology,
+		startY:   startY,
+		height:   height,
+		width:    width,
+		rows:     len(strip),
+		r:        r,
+		stride:   width + 2*r,
+		tilesX:   (width + TileSize - 1) / TileSize,
+		tilesY:   (len(strip) + TileSize - 1) / TileSize,
+		boundary: [2]bool{true, true},
+	}
+	for _, n := range rule.neighbours() {
+		s.offsets = append(s.offsets, n.dy*s.stride+n.dx)
+	}
+	s.cells = make([]byte, (s.rows+2*r)*s.stride)
+	s.scratch = make([]byte, s.stride)
+	for y, row := range strip {
+		copy(s.row(y)[r:], row)
+		s.alive += CountAliveCells([][]byte{row})
+	}
+	if rule.packable() {
+		kernel := newPackedKernel(rule)
+		s.kernel = &kernel
+		s.packed = make([][]uint64, TileSize+2)
+		for i := range s.packed {
+			s.packed[i] = make([]uint64, paddedStride(TileSize))
+		}
+	}
+	s.active = make([]bool, s.tilesX*s.tilesY)
+	s.touched = make([]bool, s.tilesX*s.tilesY)
+	for i := range s.active {
+		s.active[i] = true
+	}
+	return s
+}
+
+// row gives row y of the strip, padded either side, where y is negative or beyond the strip for halo rows.
+func (s *Sparse) row(y int) []byte {
+	start := (y + s.r) * s.stride
+	return s.cells[start : start+s.stride : start+s.stride]
+}
+
+// Step evolves the strip by one turn, given the rule.Radius halo rows above and below it and, on
+// topologies that need them, the side columns of the whole world. If above or below is empty, those
+// halo rows are taken to be the same as in the last step.
+func (s *Sparse) Step(above, below, sides [][]byte) {
+	r := s.r
+	for i := 0; i < r; i++ {
+		if len(above) > 0 {
+			s.refill(-r+i, above[i], sides)
+		} else {
+			s.refillSides(-r+i, sides)
+		}
+		if len(below) > 0 {
+			s.refill(s.rows+i, below[i], sides)
+		} else {
+			s.refillSides(s.rows+i, sides)
+		}
+	}
+	for y := 0; y < s.rows; y++ {
+		s.refillSides(y, sides)
+	}
+
+	// Work out every active tile before changing any cells, so that each tile sees the last turn
+	s.changed, s.greys = s.changed[:0], s.greys[:0]
+	for t, active := range s.active {
+		if active {
+			s.stepTile(t%s.tilesX, t/s.tilesX)
+		}
+	}
+
+	s.boundary = [2]bool{}
+	for i := range s.touched {
+		s.touched[i] = false
+	}
+	for i, cell := range s.changed {
+		c := &s.row(cell.Y)[r+cell.X]
+		if *c == 255 {
+			s.alive--
+		}
+		if s.greys[i] == 255 {
+			s.alive++
+		}
+		*c = s.greys[i]
+		s.touched[cell.Y/TileSize*s.tilesX+cell.X/TileSize] = true
+		if cell.Y < r {
+			s.boundary[0] = true
+		}
+		if cell.Y >= s.rows-r {
+			s.boundary[1] = true
+		}
+	}
+
+	// A change reaches cells up to a radius away, which may be in the tiles around it
+	reach := (r + TileSize - 1) / TileSize
+	for i := range s.active {
+		s.active[i] = false
+	}
+	for t, touched := range s.touched {
+		if touched {
+			tx, ty := t%s.tilesX, t/s.tilesX
+			s.activate(tx-reach, ty-reach, tx+reach, ty+reach)
+		}
+	}
+}
+
+// refill replaces halo row y with a world row, activating the tiles near any cells that differ.
+func (s *Sparse) refill(y int, row []byte, sides [][]byte) {
+	s.topology.fillRow(s.scratch, row, s.startY+y, s.height, s.width, s.r, sides)
+	padded := s.row(y)
+	for x := range padded {
+		if padded[x] != s.scratch[x] {
+			s.touch(x, y)
+			padded[x] = s.scratch[x]
+		}
+	}
+}
+
+// refillSides fills in the side columns of row y again, activating the tiles near any cells that differ.
+func (s *Sparse) refillSides(y int, sides [][]byte) {
+	padded := s.row(y)
+	copy(s.scratch, padded)
+	s.topology.fillSides(padded, s.startY+y, s.height, s.width, s.r, sides)
+	for i := 0; i < s.r; i++ {
+		if padded[i] != s.scratch[i] {
+			s.touch(i, y)
+		}
+		if x := s.r + s.width + i; padded[x] != s.scratch[x] {
+			s.touch(x, y)
+		}
+	}
+}
+
+// touch activates the tiles within a radius of the padded cell at column x of row y.
+func (s *Sparse) touch(x, y int) {
+	x -= s.r
+	s.activate(
+		floorDiv(x-s.r, TileSize), floorDiv(y-s.r, TileSize),
+		floorDiv(x+s.r, TileSize), floorDiv(y+s.r, TileSize))
+}
+
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// activate marks the tiles from (x0, y0) to (x1, y1) inclusive to be worked out, ignoring any beyond the strip.
+func (s *Sparse) activate(x0, y0, x1, y1 int) {
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 >= s.tilesX {
+		x1 = s.tilesX - 1
+	}
+	if y1 >= s.tilesY {
+		y1 = s.tilesY - 1
+	}
+	for ty := y0; ty <= y1; ty++ {
+		for tx := x0; tx <= x1; tx++ {
+			s.active[ty*s.tilesX+tx] = true
+		}
+	}
+}
+
+// stepTile works out the cells of a tile in the next turn, adding those that change to s.changed.
+func (s *Sparse) stepTile(tx, ty int) {
+	x0, y0 := tx*TileSize, ty*TileSize
+	x1, y1 := x0+TileSize, y0+TileSize
+	if x1 > s.width {
+		x1 = s.width
+	}
+	if y1 > s.rows {
+		y1 = s.rows
+	}
+	if s.kernel != nil {
+		s.stepPackedTile(x0, y0, x1, y1)
+		return
+	}
+	for y := y0; y < y1; y++ {
+		i := (y+s.r)*s.stride + s.r + x0
+		for x := x0; x < x1; x, i = x+1, i+1 {
+			aliveNeighbors := 0
+			for _, o := range s.offsets {
+				if s.cells[i+o] == 255 {
+					aliveNeighbors++
+				}
+			}
+			if grey := s.rule.Next(s.cells[i], aliveNeighbors); grey != s.cells[i] {
+				s.changed = append(s.changed, util.Cell{X: x, Y: y})
+				s.greys = append(s.greys, grey)
+			}
+		}
+	}
+}
+
+// stepPackedTile works out the cells from (x0, y0) up to (x1, y1) with the packed kernel, 64 at a time.
+func (s *Sparse) stepPackedTile(x0, y0, x1, y1 int) {
+	// Take the cells one beyond the tile on every side, which are at the same columns of the padded rows
+	for y := y0 - 1; y <= y1; y++ {
+		row := s.packed[y-y0+1]
+		for i := range row {
+			row[i] = 0
+		}
+		packRow(row, s.row(y)[x0:x1+2])
+	}
+
+	width := x1 - x0
+	dst := []uint64{0}
+	for y := y0; y < y1; y++ {
+		i := y - y0
+		s.kernel.step(dst, [3][]uint64{s.packed[i], s.packed[i+1], s.packed[i+2]}, width)
+		alive := shifted(s.packed[i+1], 0, 1)
+		if width < 64 {
+			alive &= 1<<width - 1
+		}
+		for diff := dst[0] ^ alive; diff != 0; diff &= diff - 1 {
+			bit := bits.TrailingZeros64(diff)
+			s.changed = append(s.changed, util.Cell{X: x0 + bit, Y: y})
+			s.greys = append(s.greys, byte(dst[0]>>bit&1)*255)
+		}
+	}
+}
+
+// StepWorld evolves a strip holding the whole world by one turn, taking its halo rows and side
+// columns from its own edges.
+func (s *Sparse) StepWorld() {
+	rows := s.Rows()
+	above := make([][]byte, s.r)
+	below := make([][]byte, s.r)
+	for i := 0; i < s.r; i++ {
+		above[i] = rows[((i-s.r)%s.height+s.height)%s.height]
+		below[i] = rows[(s.height+i)%s.height]
+	}
+	var sides [][]byte
+	if s.topology.NeedsSides() {
+		sides = SideColumns(rows, s.r)
+	}
+	s.Step(above, below, sides)
+}
+
+// Rows gives the rows of the strip. They are shared with the engine, so change with every step.
+func (s *Sparse) Rows() [][]byte {
+	rows := make([][]byte, s.rows)
+	for y := range rows {
+		rows[y] = s.row(y)[s.r : s.r+s.width : s.r+s.width]
+	}
+	return rows
+}
+
+// Strip gives a copy of the rows of the strip.
+func (s *Sparse) Strip() [][]byte {
+	strip := make([][]byte, s.rows)
+	for y, row := range s.Rows() {
+		strip[y] = append([]byte(nil), row...)
+	}
+	return strip
+}
+
+// Changed lists the cells that changed in the last step, with rows counted from the top of the strip,
+// along with the grey level each has changed to. Only the tiles that were worked out are looked at.
+func (s *Sparse) Changed() ([]util.Cell, []byte) {
+	cells := make([]util.Cell, len(s.changed))
+	copy(cells, s.changed)
+	greys := make([]byte, len(s.greys))
+	copy(greys, s.greys)
+	return cells, greys
+}
+
+// CountAlive counts the alive cells in the strip.
+func (s *Sparse) CountAlive() int {
+	return s.alive
+}
+
+// BoundaryChanged reports whether any of the top or bottom rule.Radius rows of the strip, which the
+// neighbouring strips borrow as halos, changed in the last step. Both have changed in a new strip.
+func (s *Sparse) BoundaryChanged(top bool) bool {
+	if top {
+		return s.boundary[0]
+	}
+	return s.boundary[1]
+}
@@ -0,0 +1,142 @@
+// sparse_test.go
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// placeGlider puts a glider with its top left corner at (x, y), heading right if dx is 1 or left if it
+// is -1, and down if dy is 1 or up if it is -1. A glider placed astride an edge wraps around it.
+func placeGlider(world [][]byte, x, y, dx, dy int) {
+	for _, c := range [][2]int{{1, 0}, {2, 1}, {0, 2}, {1, 2}, {2, 2}} {
+		cx, cy := c[0], c[1]
+		if dx < 0 {
+			cx = 2 - cx
+		}
+		if dy < 0 {
+			cy = 2 - cy
+		}
+		world[(y+cy)%len(world)][(x+cx)%len(world[0])] = 255
+	}
+}
+
+// checkSparse evolves the world with both Sparse and NextWorld, checking the cells, the changes Sparse
+// reports and its count of alive cells after every turn.
+func checkSparse(t *testing.T, world [][]byte, height, width, turns int, rule Rule, topology Topology) {
+	t.Helper()
+	s := NewSparse(world, 0, height, width, rule, topology)
+	for turn := 1; turn <= turns; turn++ {
+		next := NextWorld(world, height, width, rule, topology)
+		s.StepWorld()
+		if diff := firstDifference(s.Strip(), next); diff != "" {
+			t.Fatalf("turn %v: %v", turn, diff)
+		}
+		wantCells, wantGreys := ChangedCells(world, next, 0)
+		cells, greys := s.Changed()
+		changed := make(map[[2]int]byte)
+		for i, cell := range cells {
+			changed[[2]int{cell.X, cell.Y}] = greys[i]
+		}
+		if len(changed) != len(wantCells) {
+			t.Fatalf("turn %v: %v cells changed, expected %v", turn, len(changed), len(wantCells))
+		}
+		for i, cell := range wantCells {
+			if grey, ok := changed[[2]int{cell.X, cell.Y}]; !ok || grey != wantGreys[i] {
+				t.Fatalf("turn %v: change to %v not reported", turn, cell)
+			}
+		}
+		if s.CountAlive() != CountAliveCells(next) {
+			t.Fatalf("turn %v: %v alive, expected %v", turn, s.CountAlive(), CountAliveCells(next))
+		}
+		world = next
+	}
+}
+
+// TestSparseGliders tests gliders that start astride the borders between tiles and cross the edges of
+// the world, both in a world whose last row and column of tiles are cut short and in one whose edges
+// are on the borders between tiles.
+func TestSparseGliders(t *testing.T) {
+	rule, _ := ParseRule(DefaultRule)
+	for _, topology := range allTopologies {
+		for _, size := range [][2]int{{150, 140}, {192, 192}} {
+			width, height := size[0], size[1]
+			t.Run(fmt.Sprintf("%v/%dx%d", topology, width, height), func(t *testing.T) {
+				world := make([][]byte, height)
+				for y := range world {
+					world[y] = make([]byte, width)
+				}
+				placeGlider(world, TileSize-2, TileSize-2, 1, 1)
+				placeGlider(world, 2*TileSize-1, 10, 1, -1)
+				placeGlider(world, 5, 2*TileSize-1, -1, 1)
+				placeGlider(world, width-4, height-4, 1, 1)
+				placeGlider(world, 0, 0, -1, -1)
+				placeGlider(world, 100, 40, -1, 1)
+				// Long enough for every glider to wrap around at least once
+				checkSparse(t, world, height, width, 4*height+20, rule, topology)
+			})
+		}
+	}
+}
+
+// TestSparseDense tests worlds full of activity, in which every tile is worked out every turn, under each
+// kind of rule.
+func TestSparseDense(t *testing.T) {
+	forEachCase(t, testSizes, func(t *testing.T, rule Rule, topology Topology, width, height int) {
+		world := randomWorld(rand.New(rand.NewSource(7)), height, width, rule)
+		checkSparse(t, world, height, width, 20, rule, topology)
+	})
+}
+
+// TestSparseStrips tests strips that are given their halo rows by their neighbours, as the workers do,
+// only when those rows have changed.
+func TestSparseStrips(t *testing.T) {
+	forEachCase(t, [][2]int{{130, 150}}, func(t *testing.T, rule Rule, topology Topology, width, height int) {
+		world := make([][]byte, height)
+		for y := range world {
+			world[y] = make([]byte, width)
+		}
+		// A dense patch near the border between the strips, and gliders elsewhere
+		patch := randomWorld(rand.New(rand.NewSource(8)), 20, 20, rule)
+		for y := range patch {
+			copy(world[65+y][50:], patch[y])
+		}
+		placeGlider(world, 10, 140, 1, 1)
+		placeGlider(world, 120, 5, 1, -1)
+
+		bounds := []int{0, 75, height}
+		strips := make([]*Sparse, 2)
+		for i := range strips {
+			strips[i] = NewSparse(world[bounds[i]:bounds[i+1]], bounds[i], height, width, rule, topology)
+		}
+		r := rule.Radius
+		halo := func(y0, y1 int) [][]byte {
+			var rows [][]byte
+			for y := y0; y < y1; y++ {
+				rows = append(rows, append([]byte(nil), world[(y%height+height)%height]...))
+			}
+			return rows
+		}
+		for turn := 1; turn <= 60; turn++ {
+			// Each strip's halos are the other's boundary rows, so only send them if those changed last turn
+			send := make([]bool, len(strips))
+			for i := range strips {
+				other := strips[(i+1)%2]
+				send[i] = turn == 1 || other.BoundaryChanged(true) || other.BoundaryChanged(false)
+			}
+			for i, s := range strips {
+				var above, below [][]byte
+				if send[i] {
+					above, below = halo(bounds[i]-r, bounds[i]), halo(bounds[i+1], bounds[i+1]+r)
+				}
+				s.Step(above, below, stripSides(world, bounds[i], bounds[i+1], rule, topology))
+			}
+			world = NextWorld(world, height, width, rule, topology)
+			got := append(strips[0].Strip(), strips[1].Strip()...)
+			if diff := firstDifference(got, world); diff != "" {
+				t.Fatalf("turn %v: %v", turn, diff)
+			}
+		}
+	})
+}
@@ -0,0 +1,175 @@
+// topology.go
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Topology is the surface the world is drawn on: which of its edges are joined to which, and whether
+// a pair of joined edges is twisted, so that cells crossing one come back mirrored across the other.
+type Topology int
+
+const (
+	Torus        Topology = iota // Left joined to right and top to bottom
+	Plane                        // No edges joined; cells beyond them are dead
+	Cylinder                     // Left joined to right; cells beyond the top and bottom are dead
+	KleinBottle                  // Left joined to right, and top to bottom with a twist
+	CrossSurface                 // Left joined to right and top to bottom, both with a twist
+)
+
+var topologyNames = []string{"torus", "plane", "cylinder", "klein-bottle", "cross-surface"}
+
+// ParseTopology reads a topology by name: torus, plane, cylinder, klein-bottle or cross-surface.
+// An empty string gives Torus.
+func ParseTopology(s string) (Topology, error) {
+	if s == "" {
+		return Torus, nil
+	}
+	for t, name := range topologyNames {
+		if strings.EqualFold(s, name) {
+			return Topology(t), nil
+		}
+	}
+	return Torus, fmt.Errorf("invalid topology %q: expected one of %v", s, strings.Join(topologyNames, ", "))
+}
+
+// String gives the name of the topology, which ParseTopology reads back.
+func (t Topology) String() string {
+	return topologyNames[t]
+}
+
+// wrapsX reports whether the left and right edges are joined.
+func (t Topology) wrapsX() bool {
+	return t != Plane
+}
+
+// wrapsY reports whether the top and bottom edges are joined.
+func (t Topology) wrapsY() bool {
+	return t == Torus || t == KleinBottle || t == CrossSurface
+}
+
+// locate finds the cell of the world that position (x, y) stands for, where the position may be beyond
+// the edges of the world, reporting false if it is beyond an edge the topology does not join up.
+func (t Topology) locate(x, y, width, height int) (int, int, bool) {
+	if y < 0 || y >= height {
+		if !t.wrapsY() {
+			return 0, 0, false
+		}
+		y = (y%height + height) % height
+		if t == KleinBottle || t == CrossSurface {
+			x = width - 1 - x
+		}
+	}
+	if x < 0 || x >= width {
+		if !t.wrapsX() {
+			return 0, 0, false
+		}
+		x = (x%width + width) % width
+		if t == CrossSurface {
+			y = height - 1 - y
+		}
+	}
+	return x, y, true
+}
+
+// NeedsSides reports whether evolving a strip of the world needs the side columns of every row,
+// as it does on a cross-surface, where a cell crossing the left or right edge comes back upside down.
+func (t Topology) NeedsSides() bool {
+	return t == CrossSurface
+}
+
+// SideColumns gives the leftmost and rightmost radius columns of each row, in that order.
+// They are what strips of a cross-surface need from the rest of the world, besides their halos.
+func SideColumns(rows [][]byte, radius int) [][]byte {
+	sides := make([][]byte, len(rows))
+	for y, row := range rows {
+		n := radius
+		if n > len(row) {
+			n = len(row)
+		}
+		sides[y] = make([]byte, 0, 2*n)
+		sides[y] = append(sides[y], row[:n]...)
+		sides[y] = append(sides[y], row[len(row)-n:]...)
+	}
+	return sides
+}
+
+// SidesNeeded gives the rows whose side columns a strip from startY to endY needs, as the first of them
+// and how many there are, counting on from the first past the bottom edge to the top. On a cross-surface
+// they are the rows that the strip's own rows and halo rows meet upside down across the left and right edges.
+func SidesNeeded(startY, endY, height, radius int) (int, int) {
+	n := endY - startY + 2*radius
+	if n >= height {
+		return 0, height
+	}
+	return ((height-endY-radius)%height + height) % height, n
+}
+
+// sideCell looks up the cell at column x of a row from the row's side columns.
+func sideCell(side []byte, x, width int) byte {
+	n := len(side) / 2
+	if x < n {
+		return side[x]
+	}
+	return side[n+x-(width-n)]
+}
+
+// padRow gives a row of the strip widened by radius columns either side, with the cells beyond the
+// left and right edges filled in as the topology joins them up. y is the row's position in the world,
+// which is beyond the top or bottom edge for halo rows; row is the world row it wraps around to.
+func (t Topology) padRow(row []byte, y, height, width, radius int, sides [][]byte) []byte {
+	padded := make([]byte, width+2*radius)
+	t.fillRow(padded, row, y, height, width, radius, sides)
+	return padded
+}
+
+// fillRow is padRow writing into an existing padded row.
+func (t Topology) fillRow(padded, row []byte, y, height, width, radius int, sides [][]byte) {
+	if !t.wrapsY() && (y < 0 || y >= height) {
+		// Beyond a top or bottom edge that is not joined
+		for x := range padded {
+			padded[x] = 0
+		}
+		return
+	}
+
+	twisted := (y < 0 || y >= height) && (t == KleinBottle || t == CrossSurface)
+	for x := range row {
+		if twisted {
+			padded[radius+x] = row[width-1-x]
+		} else {
+			padded[radius+x] = row[x]
+		}
+	}
+	t.fillSides(padded, y, height, width, radius, sides)
+}
+
+// fillSides fills in the cells beyond the left and right edges of a padded row whose middle is in place.
+func (t Topology) fillSides(padded []byte, y, height, width, radius int, sides [][]byte) {
+	beyond := y < 0 || y >= height
+	if !t.wrapsX() || beyond && !t.wrapsY() {
+		for i := 0; i < radius; i++ {
+			padded[i], padded[radius+width+i] = 0, 0
+		}
+		return
+	}
+
+	twisted := beyond && (t == KleinBottle || t == CrossSurface)
+	y = (y%height + height) % height
+	side := func(x int) byte {
+		wrapped := (x%width + width) % width
+		if t != CrossSurface {
+			return padded[radius+wrapped]
+		}
+		// Crossing a side of the world flips the cell upside down
+		if twisted {
+			wrapped = width - 1 - wrapped
+		}
+		return sideCell(sides[height-1-y], wrapped, width)
+	}
+	for i := 0; i < radius; i++ {
+		padded[radius-1-i] = side(-1 - i)
+		padded[radius+width+i] = side(width + i)
+	}
+}
@@ -0,0 +1,207 @@
+// generate.go
+package generate
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"uk.ac.bris.cs/gameoflife/patterns"
+)
+
+// Options describe how to generate a world. The same options always generate the same world, so a
+// run started from a generated world can be repeated from the options alone.
+type Options struct {
+	Generator string  // random, soup, noise or patterns
+	Symmetry  string  // Symmetry of a soup: C1, C2, C4, D2, D4 or D8; empty for C1
+	Density   float64 // Fraction of cells alive; for patterns, the number placed per 256 cells
+	Seed      int64   // Seed of the random number generator
+}
+
+// String gives the options as "key=value" pairs, as recorded alongside the worlds they generate.
+func (o Options) String() string {
+	s := fmt.Sprintf("generate=%v", o.Generator)
+	if o.Generator == "soup" {
+		s += fmt.Sprintf(" symmetry=%v", o.symmetry())
+	}
+	return s + fmt.Sprintf(" density=%v seed=%v", o.Density, o.Seed)
+}
+
+func (o Options) symmetry() string {
+	if o.Symmetry == "" {
+		return "C1"
+	}
+	return strings.ToUpper(o.Symmetry)
+}
+
+// World generates a world of the given size. The generators are:
+//
+//	random    every cell alive with a probability of Density
+//	soup      a random world with the symmetry named by Symmetry, as in Catagolue's soups: C2 and C4 are
+//	          rotations by a half and a quarter turn, D2 a reflection left to right, D4 reflections in
+//	          both axes and D8 every rotation and reflection of a square
+//	noise     blobs of life drawn from smooth random noise, covering Density of the world
+//	patterns  patterns from the library in random places and orientations
+func World(o Options, height, width int) ([][]byte, error) {
+	if height <= 0 || width <= 0 {
+		return nil, fmt.Errorf("invalid world size %dx%d", width, height)
+	}
+	world := make([][]byte, height)
+	for y := range world {
+		world[y] = make([]byte, width)
+	}
+	r := rand.New(rand.NewSource(o.Seed))
+
+	switch o.Generator {
+	case "random":
+		for y := range world {
+			for x := range world[y] {
+				if r.Float64() < o.Density {
+					world[y][x] = 255
+				}
+			}
+		}
+	case "soup":
+		return world, soup(world, r, o.symmetry(), o.Density)
+	case "noise":
+		noise(world, r, o.Density)
+	case "patterns":
+		placePatterns(world, r, o.Density)
+	default:
+		return nil, fmt.Errorf("unknown generator %q: expected random, soup, noise or patterns", o.Generator)
+	}
+	return world, nil
+}
+
+// transform maps a cell of a world to where a symmetry takes it
+type transform func(x, y, width, height int) (int, int)
+
+var (
+	identity      transform = func(x, y, w, h int) (int, int) { return x, y }
+	flipX         transform = func(x, y, w, h int) (int, int) { return w - 1 - x, y }
+	flipY         transform = func(x, y, w, h int) (int, int) { return x, h - 1 - y }
+	halfTurn      transform = func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y }
+	quarterTurn   transform = func(x, y, w, h int) (int, int) { return w - 1 - y, x }
+	threeQuarters transform = func(x, y, w, h int) (int, int) { return y, h - 1 - x }
+	transpose     transform = func(x, y, w, h int) (int, int) { return y, x }
+	antitranspose transform = func(x, y, w, h int) (int, int) { return w - 1 - y, h - 1 - x }
+)
+
+// symmetries lists every transform in each symmetry group. Those that turn the world on its side
+// only fit square worlds.
+var symmetries = map[string][]transform{
+	"C1": {identity},
+	"C2": {identity, halfTurn},
+	"C4": {identity, quarterTurn, halfTurn, threeQuarters},
+	"D2": {identity, flipX},
+	"D4": {identity, flipX, flipY, halfTurn},
+	"D8": {identity, flipX, flipY, halfTurn, quarterTurn, threeQuarters, transpose, antitranspose},
+}
+
+// soup fills a world at random, giving every cell the same state as the cells the symmetry maps it to.
+func soup(world [][]byte, r *rand.Rand, symmetry string, density float64) error {
+	group, ok := symmetries[symmetry]
+	if !ok {
+		return fmt.Errorf("unknown symmetry %q: expected C1, C2, C4, D2, D4 or D8", symmetry)
+	}
+	height, width := len(world), len(world[0])
+	if (symmetry == "C4" || symmetry == "D8") && width != height {
+		return fmt.Errorf("%v symmetry needs a square world, not %dx%d", symmetry, width, height)
+	}
+
+	values := make([]float64, width*height)
+	for i := range values {
+		values[i] = r.Float64()
+	}
+	for y := range world {
+		for x := range world[y] {
+			// Every cell takes the value of the first cell of its orbit
+			first := y*width + x
+			for _, t := range group {
+				tx, ty := t(x, y, width, height)
+				if i := ty*width + tx; i < first {
+					first = i
+				}
+			}
+			if values[first] < density {
+				world[y][x] = 255
+			}
+		}
+	}
+	return nil
+}
+
+// noiseScales are the spacings in cells of the lattices of random values that are blended into noise,
+// from the coarsest to the finest
+var noiseScales = []int{32, 16, 8}
+
+// noise brings the cells where smooth random noise is lowest to life, until density of the world is alive.
+func noise(world [][]byte, r *rand.Rand, density float64) {
+	height, width := len(world), len(world[0])
+	values := make([]float64, width*height)
+	amplitude := 1.0
+	for _, scale := range noiseScales {
+		// A lattice of random values one every scale cells, wrapping around the edges of the world
+		latticeW, latticeH := (width+scale-1)/scale, (height+scale-1)/scale
+		lattice := make([]float64, latticeW*latticeH)
+		for i := range lattice {
+			lattice[i] = r.Float64()
+		}
+		at := func(lx, ly int) float64 {
+			return lattice[(ly%latticeH)*latticeW+lx%latticeW]
+		}
+		for y := 0; y < height; y++ {
+			ly, fy := y/scale, smooth(float64(y%scale)/float64(scale))
+			for x := 0; x < width; x++ {
+				lx, fx := x/scale, smooth(float64(x%scale)/float64(scale))
+				top := at(lx, ly) + (at(lx+1, ly)-at(lx, ly))*fx
+				bottom := at(lx, ly+1) + (at(lx+1, ly+1)-at(lx, ly+1))*fx
+				values[y*width+x] += amplitude * (top + (bottom-top)*fy)
+			}
+		}
+		amplitude /= 2
+	}
+
+	// The noise is not spread evenly, so find the level below which the right fraction of cells lie
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	alive := int(math.Round(density * float64(len(values))))
+	if alive <= 0 {
+		return
+	}
+	threshold := math.Inf(1)
+	if alive < len(sorted) {
+		threshold = sorted[alive]
+	}
+	for y := range world {
+		for x := range world[y] {
+			if values[y*width+x] < threshold {
+				world[y][x] = 255
+			}
+		}
+	}
+}
+
+// smooth eases the blend between lattice values so that the noise has no creases.
+func smooth(t float64) float64 {
+	return t * t * (3 - 2*t)
+}
+
+// placePatterns stamps patterns from the library onto the world, density to every 256 cells, each
+// turned and reflected at random and wrapping around the edges of the world.
+func placePatterns(world [][]byte, r *rand.Rand, density float64) {
+	height, width := len(world), len(world[0])
+	names := patterns.Names()
+	count := int(math.Round(density * float64(width*height) / 256))
+	for i := 0; i < count; i++ {
+		patterns.Place(world, patterns.Placement{
+			Pattern: names[r.Intn(len(names))],
+			X:       r.Intn(width),
+			Y:       r.Intn(height),
+			Rotate:  r.Intn(4),
+			Flip:    r.Intn(2) == 1,
+		})
+	}
+}
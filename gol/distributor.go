@@ -2,11 +2,16 @@ package gol
 
 import (
 	"fmt"
-	"log"
 	"net/rpc"
 	"strconv"
+	"sync"
 	"time"
+	"uk.ac.bris.cs/gameoflife/checkpoint"
+	"uk.ac.bris.cs/gameoflife/engine"
+	"uk.ac.bris.cs/gameoflife/generate"
+	"uk.ac.bris.cs/gameoflife/patterns"
 	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
 )
 
 type distributorChannels struct {
@@ -14,66 +19,216 @@ type distributorChannels struct {
 	ioCommand  chan<- ioCommand
 	ioIdle     <-chan bool
 	ioFilename chan<- string
-	ioOutput   chan<- uint8
-	ioInput    <-chan uint8
+	ioOutput   chan<- []byte
+	ioInput    <-chan []byte
+	ioRule     chan string
 	ioKeypress <-chan rune
 }
 
 // distributor divides the work between workers and interacts with other goroutines.
 func distributor(p Params, c distributorChannels) {
-	// Initialize a 2D slice to store the world.
-	world := make([][]byte, p.ImageHeight)
-	for i := range world {
-		world[i] = make([]byte, p.ImageWidth)
+	file := fmt.Sprintf("%dx%d", p.ImageWidth, p.ImageHeight)
+	input := p.Input
+	if input == "" {
+		input = "images/" + file + ".pgm"
 	}
-
-	file := strconv.Itoa(p.ImageWidth)
-	file = file + "x" + file
-	c.ioCommand <- ioInput
-	c.ioFilename <- file
-
-	// Populate the world with data read from the input PGM file.
-	for y := range world {
-		for x := range world[y] {
-			world[y][x] = <-c.ioInput
-		}
+	if _, _, err := p.outputFormat(); err != nil {
+		fmt.Println("Cannot save images:", err)
+		abort(c, 0)
+		return
 	}
-
-	turn := 0
-	c.events <- StateChange{turn, Executing}
+	if _, err := parsePalette(p.Palette); err != nil {
+		fmt.Println("Cannot draw images:", err)
+		abort(c, 0)
+		return
+	}
+	rec, err := newRecorder(p)
+	if err != nil {
+		fmt.Println("Cannot record:", err)
+		abort(c, 0)
+		return
+	}
+	defer rec.close()
 
 	// Connect to the Game of Life server over RPC.
-	client, err := rpc.Dial("tcp", ":8030")
+	client, err := dialServer(p)
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
+		abort(c, 0)
 		return
 	}
 	defer client.Close()
 
-	// Prepare a request to send to the server with the initial world state and parameters.
-	request := stubs.Request{
-		InitialWorld: world,
-		ImageWidth:   p.ImageWidth,
-		ImageHeight:  p.ImageHeight,
-		Turns:        p.Turns,
+	var session, turn int
+	var world [][]byte
+	rule, topology, generator := p.Rule, p.Topology, ""
+	if p.Attach {
+		// Join the simulation already running on the server rather than starting a new one.
+		attachResponse := new(stubs.AttachResponse)
+		err = client.Call(stubs.AttachHandler, stubs.AttachRequest{Session: p.Session}, attachResponse)
+		if err != nil {
+			fmt.Println("Error in Attach RPC call:", err)
+			abort(c, 0)
+			return
+		}
+		if attachResponse.ImageWidth != p.ImageWidth || attachResponse.ImageHeight != p.ImageHeight {
+			// Run takes the size from the session, so it can only differ if the session could not be looked up then
+			fmt.Printf("Running simulation is %dx%d, not %dx%d\n",
+				attachResponse.ImageWidth, attachResponse.ImageHeight, p.ImageWidth, p.ImageHeight)
+			abort(c, attachResponse.Turn)
+			return
+		}
+		session, turn, world = attachResponse.Session, attachResponse.Turn, attachResponse.World
+		rule, topology = attachResponse.Rule, attachResponse.Topology
+		if err := checkOutputRule(p, rule); err != nil {
+			fmt.Println("Cannot save images:", err)
+			abort(c, turn)
+			return
+		}
+
+		if len(p.Stamps) > 0 {
+			// The stamped cells arrive with the changes of the next turn.
+			injectRequest := stubs.InjectRequest{Session: session, Placements: p.Stamps}
+			err = client.Call(stubs.InjectHandler, injectRequest, new(stubs.InjectResponse))
+			if err != nil {
+				fmt.Println("Error in Inject RPC call:", err)
+			}
+		}
+	} else {
+		if p.Restore != "" {
+			// Carry on from a checkpoint the server saved earlier.
+			saved, err := checkpoint.Read(p.Restore)
+			if err != nil {
+				fmt.Println("Error reading checkpoint:", err)
+				abort(c, 0)
+				return
+			}
+			if saved.ImageWidth != p.ImageWidth || saved.ImageHeight != p.ImageHeight {
+				fmt.Printf("Checkpoint is %dx%d, not %dx%d\n",
+					saved.ImageWidth, saved.ImageHeight, p.ImageWidth, p.ImageHeight)
+				abort(c, saved.Turn)
+				return
+			}
+			if p.Rule != "" {
+				// The checkpoint's own rule set is used, so make sure it is the one asked for.
+				want, err := engine.ParseRule(p.Rule)
+				if err != nil || want.String() != saved.Rule {
+					fmt.Println("Checkpoint uses rule", saved.Rule+", not", p.Rule)
+					abort(c, saved.Turn)
+					return
+				}
+			}
+			if p.Topology != "" {
+				want, err := engine.ParseTopology(p.Topology)
+				have, _ := engine.ParseTopology(saved.Topology)
+				if err != nil || want != have {
+					fmt.Println("Checkpoint uses topology", saved.Topology+", not", p.Topology)
+					abort(c, saved.Turn)
+					return
+				}
+			}
+			world, turn, rule, topology = saved.World, saved.Turn, saved.Rule, saved.Topology
+			generator = saved.Generator
+		} else if p.Generate != "" {
+			// Generate the world rather than loading it.
+			options := p.generateOptions()
+			world, err = generate.World(options, p.ImageHeight, p.ImageWidth)
+			if err != nil {
+				fmt.Println("Error generating world:", err)
+				abort(c, 0)
+				return
+			}
+			generator = options.String()
+			fmt.Println("Generated world with", generator)
+		} else if p.Input == "" && len(p.Stamps) > 0 {
+			// Start from an empty world for the stamps below.
+			world, _ = patterns.Compose(p.ImageHeight, p.ImageWidth)
+		} else if IsPattern(input) {
+			c.ioCommand <- ioPatternInput
+			c.ioFilename <- input
+
+			// The pattern's own rule is used unless another was asked for.
+			patternRule := <-c.ioRule
+			if rule == "" && patternRule != "" {
+				rule = patternRule
+				fmt.Println("Using rule", rule, "from", input)
+			}
+			world = receiveWorld(p, c)
+		} else {
+			c.ioCommand <- ioInput
+			c.ioFilename <- input
+
+			// Populate the world with data read from the input image.
+			world = receiveWorld(p, c)
+		}
+		err = patterns.Place(world, p.Stamps...)
+		if err != nil {
+			fmt.Println("Error stamping patterns:", err)
+			abort(c, turn)
+			return
+		}
+
+		if err := checkOutputRule(p, rule); err != nil {
+			fmt.Println("Cannot save images:", err)
+			abort(c, turn)
+			return
+		}
+
+		// Prepare a request to send to the server with the initial world state and parameters.
+		request := stubs.Request{
+			InitialWorld: world,
+			ImageWidth:   p.ImageWidth,
+			ImageHeight:  p.ImageHeight,
+			Turns:        p.Turns,
+			Turn:         turn,
+			Rule:         rule,
+			Topology:     topology,
+			Generator:    generator,
+		}
+
+		// Start the simulation on the server. It runs in the background until we wait on it.
+		startResponse := new(stubs.StartResponse)
+		err = client.Call(stubs.StartHandler, request, startResponse)
+		if err != nil {
+			fmt.Println("Error in Start RPC call:", err)
+			abort(c, 0)
+			return
+		}
+		session = startResponse.Session
+		fmt.Println("Started session", session)
 	}
 
+	// Show the world as it is now, as if it had just been loaded. The server has already accepted the rule.
+	parsedRule, _ := engine.ParseRule(rule)
+	multiState := parsedRule.States > 2
+	if multiState {
+		cells, greys := visibleCells(world)
+		c.events <- CellsChanged{turn, cells, greys}
+	} else {
+		c.events <- CellsFlipped{turn, aliveCells(world)}
+	}
+	c.events <- StateChange{turn, Executing}
+
 	// Set up a ticker to call the `Alive` method every 2 seconds.
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
-	// Channel to signal when the simulation is complete.
+	// Channel to signal when the simulation is complete, and to the goroutines below to stop.
 	done := make(chan bool)
+	// Channel the key press handler uses to tell us the controller should stop.
+	quit := make(chan bool, 1)
+	var wg sync.WaitGroup
+	wg.Add(2)
 
 	// Start a goroutine for periodic alive cell count requests.
 	go func() {
-
+		defer wg.Done()
 		for {
 			select {
 			case <-ticker.C:
 
 				aliveResponse := new(stubs.AliveResponse)
-				aliveRequest := stubs.AliveRequest{ImageHeight: p.ImageHeight, ImageWidth: p.ImageWidth}
+				aliveRequest := stubs.AliveRequest{Session: session, ImageHeight: p.ImageHeight, ImageWidth: p.ImageWidth}
 				err := client.Call(stubs.AliveCellReport, aliveRequest, aliveResponse)
 				if err != nil {
 					fmt.Println("Error in Alive RPC call:", err)
@@ -90,70 +245,109 @@ func distributor(p Params, c distributorChannels) {
 		}
 	}()
 	go func() {
+		defer wg.Done()
+		paused := false
 		for {
 			select {
 			case command := <-c.ioKeypress:
-				keyRequest := stubs.KeyRequest{command}
+				keyRequest := stubs.KeyRequest{Session: session, Key: command}
 				keyResponse := new(stubs.KeyResponse)
 				err := client.Call(stubs.KeyPresshandler, keyRequest, keyResponse)
 				if err != nil {
-					log.Fatal("Key Press Call Error:", err)
+					fmt.Println("Error in key press RPC call:", err)
+					continue
 				}
 				outFileName := file + "x" + strconv.Itoa(keyResponse.Turns)
 				switch command {
 				case 's':
-					c.events <- StateChange{keyResponse.Turns, Executing}
-					savePGMImage(c, keyResponse.World, outFileName, p.ImageHeight, p.ImageWidth)
+					if !paused {
+						c.events <- StateChange{keyResponse.Turns, Executing}
+					}
+					savePGMImage(p, c, keyResponse.World, outFileName, parsedRule.String(), keyResponse.Turns)
 				case 'k':
-					err := client.Call(stubs.KillServerHandler, stubs.KillRequest{}, new(stubs.KillResponse))
-					savePGMImage(c, keyResponse.World, outFileName, p.ImageHeight, p.ImageWidth)
+					err := client.Call(stubs.KillServerHandler, stubs.KillRequest{Session: session}, new(stubs.KillResponse))
+					savePGMImage(p, c, keyResponse.World, outFileName, parsedRule.String(), keyResponse.Turns)
 					c.events <- StateChange{keyResponse.Turns, Quitting}
 					if err != nil {
-						log.Fatal("Kill Request Call Error:", err)
+						fmt.Println("Error in KillServer RPC call:", err)
 					}
-					done <- true
+					quit <- true
+					return
 				case 'q':
+					// Leave the server computing; only this controller stops.
+					if paused {
+						err := client.Call(stubs.KeyPresshandler, stubs.KeyRequest{Session: session, Key: 'p'}, new(stubs.KeyResponse))
+						if err != nil {
+							fmt.Println("Error in key press RPC call:", err)
+						}
+					}
+					savePGMImage(p, c, keyResponse.World, outFileName, parsedRule.String(), keyResponse.Turns)
 					c.events <- StateChange{keyResponse.Turns, Quitting}
-					done <- true
+					quit <- true
+					return
 				case 'p':
-					paused := true
-					fmt.Println(keyResponse.Turns)
-					c.events <- StateChange{keyResponse.Turns, Paused}
-					for paused == true {
-						command := <-c.ioKeypress
-						switch command {
-						case 'p':
-							keyRequest := stubs.KeyRequest{command}
-							keyResponse := new(stubs.KeyResponse)
-							client.Call(stubs.KeyPresshandler, keyRequest, keyResponse)
-							c.events <- StateChange{keyResponse.Turns, Executing}
-							fmt.Println("Continuing")
-							paused = false
-						}
+					// The server pauses and resumes the session; s, q and k still work while it is paused
+					paused = !paused
+					if paused {
+						fmt.Println(keyResponse.Turns)
+						c.events <- StateChange{keyResponse.Turns, Paused}
+					} else {
+						c.events <- StateChange{keyResponse.Turns, Executing}
+						fmt.Println("Continuing")
 					}
 				}
+			case <-done:
+				return
 			}
 		}
 	}()
-	// Make the RPC call to the server's Game of Life handler to start the simulation.
-	err = client.Call(stubs.ServerHandler, request, &stubs.Response{})
-	if err != nil {
-		fmt.Println("Error in GOL RPC call:", err)
-		return
-	}
 
-	// Wait until the simulation completes.
-	// Since the GOL RPC call returns immediately, we need another way to determine completion.
-	// For simplicity, we'll wait for the number of turns multiplied by the delay per turn.
-	// Alternatively, implement a mechanism to detect simulation completion via additional RPC or shared state.
-	simulationDuration := time.Duration(p.Turns) * 1 * time.Second
-	time.Sleep(simulationDuration)
+	// Relay each turn the server completes to the viewer.
+	streamed := make(chan bool)
+	go func() {
+		defer close(streamed)
+		streamTurns(client, session, turn, world, multiState, rec, c, done)
+	}()
 
-	// After simulation completes, request the final world state.
+	// Block until the server reports that the last turn has finished, or a key press stops the controller.
 	finalResponse := new(stubs.Response)
-	err = client.Call(stubs.ServerHandler, request, finalResponse)
-	if err != nil {
-		fmt.Println("Error fetching final state:", err)
+	waitCall := client.Go(stubs.WaitHandler, stubs.WaitRequest{Session: session}, finalResponse, nil)
+	quitting := false
+	select {
+	case <-waitCall.Done:
+		// Let the viewer catch up with the last turn
+		select {
+		case <-streamed:
+		case <-quit:
+			quitting = true
+		}
+	case <-quit:
+		quitting = true
+	}
+	close(done)
+	wg.Wait()
+	<-streamed
+	if err := rec.close(); err != nil {
+		fmt.Println("Cannot record:", err)
+	}
+	if !quitting {
+		select {
+		case <-quit:
+			quitting = true
+		default:
+		}
+	}
+
+	if quitting {
+		// The key press handler has already saved the world and announced that we are quitting.
+		c.ioCommand <- ioCheckIdle
+		<-c.ioIdle
+		close(c.events)
+		return
+	}
+	if waitCall.Error != nil {
+		fmt.Println("Error in Wait RPC call:", waitCall.Error)
+		abort(c, turn)
 		return
 	}
 
@@ -164,24 +358,103 @@ func distributor(p Params, c distributorChannels) {
 	}
 
 	// Output the final world state to a PGM file.
-	outputPGM(p, c, finalResponse.FinalWorld, finalResponse.CompletedTurns)
+	outputPGM(p, c, finalResponse.FinalWorld, finalResponse.CompletedTurns, parsedRule.String())
+}
 
-	// Signal that the simulation is complete.
-	done <- true
+// aliveCells collects the coordinates of all live cells in the world.
+func aliveCells(world [][]byte) []util.Cell {
+	cells := []util.Cell{}
+	for y := range world {
+		for x := range world[y] {
+			if world[y][x] == 255 {
+				cells = append(cells, util.Cell{X: x, Y: y})
+			}
+		}
+	}
+	return cells
+}
 
+// visibleCells collects the coordinates and grey levels of all cells in the world that are not dead.
+func visibleCells(world [][]byte) ([]util.Cell, []byte) {
+	cells := []util.Cell{}
+	greys := []byte{}
+	for y := range world {
+		for x := range world[y] {
+			if world[y][x] != 0 {
+				cells = append(cells, util.Cell{X: x, Y: y})
+				greys = append(greys, world[y][x])
+			}
+		}
+	}
+	return cells, greys
 }
 
-// outputPGM saves the final world state to a PGM file.
-func outputPGM(p Params, c distributorChannels, world [][]byte, completedTurns int) {
-	// Output the final state to IO channels
-	c.ioCommand <- ioOutput
-	outputFilename := fmt.Sprintf("%dx%dx%d", p.ImageHeight, p.ImageWidth, p.Turns)
-	c.ioFilename <- outputFilename
-	for y := 0; y < p.ImageHeight; y++ {
-		for x := 0; x < p.ImageWidth; x++ {
-			c.ioOutput <- world[y][x]
+// abort tells the user the controller has given up and closes the events channel.
+func abort(c distributorChannels, turn int) {
+	c.events <- StateChange{turn, Quitting}
+	close(c.events)
+}
+
+// dialServer connects to p.Server, falling back to each of p.Fallbacks in order if it cannot be reached.
+func dialServer(p Params) (*rpc.Client, error) {
+	server := p.Server
+	if server == "" {
+		server = DefaultServer
+	}
+	var err error
+	for _, address := range append([]string{server}, p.Fallbacks...) {
+		var client *rpc.Client
+		client, err = rpc.Dial("tcp", address)
+		if err == nil {
+			return client, nil
 		}
+		fmt.Println("Could not reach server", address+":", err)
 	}
+	return nil, err
+}
+
+// receiveWorld reads the world the io goroutine loaded, one row after another.
+func receiveWorld(p Params, c distributorChannels) [][]byte {
+	world := make([][]byte, p.ImageHeight)
+	for y := range world {
+		world[y] = <-c.ioInput
+	}
+	return world
+}
+
+// checkOutputRule makes sure that worlds evolved under the rule can be saved in the output format.
+// Pattern files only hold alive cells, so cannot hold the dying states of a Generations rule. An
+// invalid rule is left for the server to refuse.
+func checkOutputRule(p Params, rule string) error {
+	ext, magic, _ := p.outputFormat()
+	parsed, err := engine.ParseRule(rule)
+	if magic != "" || err != nil || parsed.States <= 2 {
+		return nil
+	}
+	return fmt.Errorf("%v files cannot hold the dying states of rule %v", ext, parsed)
+}
+
+// sendWorld passes the world to the io goroutine a row at a time to save to a file in the output format.
+// Pattern formats record the rule as well. The world must not change until the io goroutine is idle.
+func sendWorld(p Params, c distributorChannels, world [][]byte, file, rule string) {
+	if _, magic, _ := p.outputFormat(); magic == "" {
+		c.ioCommand <- ioPatternOutput
+		c.ioFilename <- file
+		c.ioRule <- rule
+	} else {
+		c.ioCommand <- ioOutput
+		c.ioFilename <- file
+	}
+	for _, row := range world {
+		c.ioOutput <- row
+	}
+}
+
+// outputPGM saves the final world state in the output format.
+func outputPGM(p Params, c distributorChannels, world [][]byte, completedTurns int, rule string) {
+	// Output the final state to IO channels
+	outputFilename := fmt.Sprintf("%dx%dx%d", p.ImageWidth, p.ImageHeight, p.Turns)
+	sendWorld(p, c, world, outputFilename, rule)
 
 	// Ensure IO has completed any pending tasks before quitting
 	c.ioCommand <- ioCheckIdle
@@ -189,12 +462,11 @@ func outputPGM(p Params, c distributorChannels, world [][]byte, completedTurns i
 	c.events <- StateChange{completedTurns, Quitting}
 	close(c.events)
 }
-func savePGMImage(c distributorChannels, w [][]byte, file string, imageHeight, imageWidth int) {
-	c.ioCommand <- ioOutput
-	c.ioFilename <- file
-	for y := 0; y < imageHeight; y++ {
-		for x := 0; x < imageWidth; x++ {
-			c.ioOutput <- w[y][x]
-		}
-	}
+
+// savePGMImage saves a snapshot of the world taken part way through the simulation in the output format.
+func savePGMImage(p Params, c distributorChannels, w [][]byte, file, rule string, completedTurns int) {
+	sendWorld(p, c, w, file, rule)
+	c.ioCommand <- ioCheckIdle
+	<-c.ioIdle
+	c.events <- ImageOutputComplete{completedTurns, file}
 }
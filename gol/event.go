@@ -17,6 +17,7 @@ type Event interface {
 
 // `AliveCellsCount` is an Event notifying the user about the number of currently alive cells.
 // This Event should be sent every 2s.
+// Dying cells of "Generations" rule sets are not counted as alive.
 type AliveCellsCount struct { // implements Event
 	CompletedTurns int
 	CellsCount     int
@@ -63,6 +64,16 @@ type CellsFlipped struct { // implements Event
 	Cells          []util.Cell
 }
 
+// `CellsChanged` is an Event notifying the GUI that cells of a world with more than two states have changed.
+// It is sent instead of `CellsFlipped` for "Generations" rule sets, where a dying cell passes through
+// intermediate states. Each cell's new state is given as the grey level it has in PGM output:
+// 255 is alive, 0 is dead and the levels in between are dying.
+type CellsChanged struct { // implements Event
+	CompletedTurns int
+	Cells          []util.Cell
+	Greys          []uint8
+}
+
 // `TurnComplete` is an Event notifying the GUI about turn completion.
 // SDL will render a frame when this event is sent.
 // All `CellFlipped` or `CellsFlipped` events must be sent *before* `TurnComplete`.
@@ -133,6 +144,14 @@ func (event CellsFlipped) GetCompletedTurns() int {
 	return event.CompletedTurns
 }
 
+func (event CellsChanged) String() string {
+	return ""
+}
+
+func (event CellsChanged) GetCompletedTurns() int {
+	return event.CompletedTurns
+}
+
 func (event TurnComplete) String() string {
 	return ""
 }
@@ -1,23 +1,105 @@
 package gol
 
+import (
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/generate"
+	"uk.ac.bris.cs/gameoflife/patterns"
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
 // Params provides the details of how to run the Game of Life and which image to load.
 type Params struct {
 	Turns       int
 	Threads     int
 	ImageWidth  int
 	ImageHeight int
+	Input       string   // PBM or PGM image, or RLE, .cells or .mc pattern, to load the world from; defaults to images/WxH.pgm
+	Output      string   // Format of the images saved, by extension: pgm, pbm, rle, cells or mc; empty for pgm
+	Plain       bool     // Save images in the plain Netpbm formats, which write the cells out as text
+	Server      string   // Address of the Game of Life server; defaults to DefaultServer
+	Fallbacks   []string // Servers to try in order if Server cannot be reached
+	Attach      bool     // Join the simulation already running on the server instead of starting one, taking on its size and rule
+	Session     int      // Session to join when attaching; 0 joins the most recently started one
+	Restore     string   // Checkpoint file to resume from instead of loading the input image
+	Rule        string   // Rule set in Birth/Survival or Larger than Life notation, such as "B36/S23"; empty for Conway's
+	Topology    string   // Surface the world is drawn on: torus, plane, cylinder, klein-bottle or cross-surface; empty for a torus
+	Generate    string   // Generator to make the initial world with instead of loading an image: random, soup, noise or patterns
+	Symmetry    string   // Symmetry of a generated soup, such as "D4"; empty for none
+	Density     float64  // Fraction of generated cells alive; for patterns, the number placed per 256 cells
+	Seed        int64    // Seed for generating the world; 0 picks one from the clock
+
+	Offset util.Cell // Where a pattern loaded from Input is placed, relative to the middle of the world
+
+	PNG         bool   // Save a PNG of the world alongside every image saved
+	Record      string // Animated GIF, or PNG with the .png or .apng extension, to record the run to; empty for none
+	RecordEvery int    // Record every this many turns; 0 records every turn
+	Scale       int    // Pixels a side each cell is drawn as in PNGs and recordings; 0 for 1
+	Palette     string // Colours PNGs and recordings are drawn in: grey, paper, green, amber or #rrggbb,#rrggbb
+
+	// Patterns from the library stamped onto the initial world, which is empty unless an image, generator
+	// or checkpoint gives one. When attaching, they are stamped onto the running simulation instead.
+	Stamps []patterns.Placement
+}
+
+// generateOptions gives the options for generating the initial world.
+func (p Params) generateOptions() generate.Options {
+	return generate.Options{Generator: p.Generate, Symmetry: p.Symmetry, Density: p.Density, Seed: p.Seed}
+}
+
+// generatedComment gives the options the initial world was generated with, which every output records
+// so that the run can be repeated, or an empty string if the world was not generated.
+func (p Params) generatedComment() string {
+	if p.Generate == "" {
+		return ""
+	}
+	return p.generateOptions().String()
+}
+
+// AttachParams gives the parameters for joining the simulation p.Session on the server, with the session's
+// ID, size, rule and topology in place of those given, so that the view and the outputs match it.
+func AttachParams(p Params) (Params, error) {
+	client, err := dialServer(p)
+	if err != nil {
+		return p, err
+	}
+	defer client.Close()
+	res := new(stubs.AttachResponse)
+	err = client.Call(stubs.AttachHandler, stubs.AttachRequest{Session: p.Session, NoWorld: true}, res)
+	if err != nil {
+		return p, err
+	}
+	p.Session, p.ImageWidth, p.ImageHeight = res.Session, res.ImageWidth, res.ImageHeight
+	p.Rule, p.Topology = res.Rule, res.Topology
+	return p, nil
 }
 
+// DefaultServer is the server address used when Params.Server is empty.
+const DefaultServer = "localhost:8030"
+
 // Run starts the processing of Game of Life. It should initialise channels and goroutines.
 func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
+	if p.Generate != "" && p.Seed == 0 {
+		// Settle on a seed now, so that it can be recorded with the output
+		p.Seed = time.Now().UnixNano()
+	}
+
+	if p.Attach {
+		// Everything below must match the running simulation; if it cannot be reached, the distributor says so
+		if attached, err := AttachParams(p); err == nil {
+			p = attached
+		}
+	}
 
 	//	TODO: Put the missing channels in here.
 
 	ioCommand := make(chan ioCommand)
 	ioIdle := make(chan bool)
 	ioFilename := make(chan string) // To pass filenames between distributor and IO.
-	ioOutput := make(chan uint8)    // To pass output data (world state) to IO.
-	ioInput := make(chan uint8)     // To receive input data (world state) from IO.
+	ioOutput := make(chan []byte)   // To pass output data (world state) to IO, a row at a time.
+	ioInput := make(chan []byte)    // To receive input data (world state) from IO, a row at a time.
+	ioRule := make(chan string)     // To pass the rules of patterns between distributor and IO.
 
 	ioChannels := ioChannels{
 		command:  ioCommand,
@@ -25,6 +107,7 @@ func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
 		filename: ioFilename,
 		output:   ioOutput,
 		input:    ioInput,
+		rule:     ioRule,
 	}
 	go startIo(p, ioChannels)
 
@@ -35,6 +118,7 @@ func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
 		ioFilename: ioFilename,
 		ioOutput:   ioOutput,
 		ioInput:    ioInput,
+		ioRule:     ioRule,
 		ioKeypress: keyPresses,
 	}
 	distributor(p, distributorChannels)
@@ -3,8 +3,9 @@ package gol
 import (
 	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"uk.ac.bris.cs/gameoflife/patterns"
 	"uk.ac.bris.cs/gameoflife/util"
 )
 
@@ -13,8 +14,9 @@ type ioChannels struct {
 	idle    chan<- bool
 
 	filename <-chan string
-	output   <-chan uint8
-	input    chan<- uint8
+	output   <-chan []byte // Rows of the world to save, which are the io goroutine's to read until it is idle
+	input    chan<- []byte // Rows of the world loaded, sent one after another
+	rule     chan string   // Rule of a pattern, sent on by the io goroutine when reading and to it when writing
 }
 
 // ioState is the internal ioState of the io goroutine.
@@ -28,102 +30,193 @@ type ioCommand uint8
 
 // This is a way of creating enums in Go.
 // It will evaluate to:
-//		ioOutput 	= 0
-//		ioInput 	= 1
-//		ioCheckIdle = 2
+//
+//	ioOutput 	= 0
+//	ioInput 	= 1
+//	ioCheckIdle = 2
+//	ioPatternOutput = 3
+//	ioPatternInput = 4
 const (
 	ioOutput ioCommand = iota
 	ioInput
 	ioCheckIdle
+	ioPatternOutput
+	ioPatternInput
 )
 
-// writePgmImage receives an array of bytes and writes it to a pgm file.
-func (io *ioState) writePgmImage() {
+// writeImage receives the world a row at a time and writes each row to an image in the output format as
+// it arrives.
+func (io *ioState) writeImage() {
 	_ = os.Mkdir("out", os.ModePerm)
 
 	// Request a filename from the distributor.
 	filename := <-io.channels.filename
 
-	file, ioError := os.Create("out/" + filename + ".pgm")
+	ext, magic, err := io.params.outputFormat()
+	util.Check(err)
+
+	file, ioError := os.Create("out/" + filename + "." + ext)
 	util.Check(ioError)
 	defer file.Close()
 
-	_, _ = file.WriteString("P5\n")
-	//_, _ = file.WriteString("# PGM file writer by pnmmodules (https://github.com/owainkenwayucl/pnmmodules).\n")
-	_, _ = file.WriteString(strconv.Itoa(io.params.ImageWidth))
-	_, _ = file.WriteString(" ")
-	_, _ = file.WriteString(strconv.Itoa(io.params.ImageHeight))
-	_, _ = file.WriteString("\n")
-	_, _ = file.WriteString(strconv.Itoa(255))
-	_, _ = file.WriteString("\n")
-
-	world := make([][]byte, io.params.ImageHeight)
-	for i := range world {
-		world[i] = make([]byte, io.params.ImageWidth)
-	}
-
-	for y := 0; y < io.params.ImageHeight; y++ {
-		for x := 0; x < io.params.ImageWidth; x++ {
-			val := <-io.channels.output
-			//if val != 0 {
-			//	fmt.Println(x, y)
-			//}
-			world[y][x] = val
-		}
+	encoder := newNetpbmEncoder(file, magic, io.params.ImageWidth, io.params.ImageHeight, io.params.generatedComment())
+	// Only keep hold of the rows if a PNG is to be drawn from them too
+	var world [][]byte
+	if io.params.PNG {
+		world = make([][]byte, io.params.ImageHeight)
 	}
-
 	for y := 0; y < io.params.ImageHeight; y++ {
-		for x := 0; x < io.params.ImageWidth; x++ {
-			_, ioError = file.Write([]byte{world[y][x]})
-			util.Check(ioError)
+		row := <-io.channels.output
+		encoder.writeRow(row)
+		if world != nil {
+			world[y] = row
 		}
 	}
+	ioError = encoder.flush()
+	util.Check(ioError)
 
 	ioError = file.Sync()
 	util.Check(ioError)
 
+	if io.params.PNG {
+		util.Check(io.writePNG(filename, world))
+	}
+
 	fmt.Println("File", filename, "output done!")
 }
 
-// readPgmImage opens a pgm file and sends its data as an array of bytes.
-func (io *ioState) readPgmImage() {
+// readImage opens a pbm or pgm image and sends its cells a row at a time.
+func (io *ioState) readImage() {
 
-	// Request a filename from the distributor.
+	// Request the path of the image from the distributor.
 	filename := <-io.channels.filename
 
-	data, ioError := os.ReadFile("images/" + filename + ".pgm")
+	data, ioError := os.ReadFile(filename)
 	util.Check(ioError)
 
-	fields := strings.Fields(string(data))
-
-	if fields[0] != "P5" {
-		panic("Not a pgm file")
-	}
-
-	width, _ := strconv.Atoi(fields[1])
+	width, height, cells, err := decodeNetpbm(filename, data)
+	util.Check(err)
 	if width != io.params.ImageWidth {
 		panic("Incorrect width")
 	}
-
-	height, _ := strconv.Atoi(fields[2])
 	if height != io.params.ImageHeight {
 		panic("Incorrect height")
 	}
 
-	maxval, _ := strconv.Atoi(fields[3])
-	if maxval != 255 {
-		panic("Incorrect maxval/bit depth")
+	for y := 0; y < height; y++ {
+		io.channels.input <- cells[y*width : (y+1)*width : (y+1)*width]
 	}
 
-	image := []byte(fields[4])
+	fmt.Println("File", filename, "input done!")
+}
 
-	for _, b := range image {
-		io.channels.input <- b
+// IsPattern reports whether a file is a pattern, in RLE, plaintext .cells or macrocell .mc form, rather
+// than an image.
+func IsPattern(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".rle" || ext == ".cells" || ext == ".mc"
+}
+
+// writePattern receives the rule and the world a row at a time and writes the alive cells to a pattern
+// file in the output format.
+func (io *ioState) writePattern() {
+	_ = os.Mkdir("out", os.ModePerm)
+
+	// Request a filename and the rule from the distributor.
+	filename := <-io.channels.filename
+	rule := <-io.channels.rule
+
+	ext, _, err := io.params.outputFormat()
+	util.Check(err)
+
+	world := make([][]byte, io.params.ImageHeight)
+	for y := range world {
+		world[y] = <-io.channels.output
+	}
+	p, err := patterns.FromWorld(filename, world)
+	util.Check(err)
+	p.Rule = rule
+	p.Comment = io.params.generatedComment()
+
+	file, ioError := os.Create("out/" + filename + "." + ext)
+	util.Check(ioError)
+	defer file.Close()
+
+	switch ext {
+	case "rle":
+		ioError = patterns.WriteRLE(file, p)
+	case "mc":
+		ioError = patterns.WriteMacrocell(file, p)
+	default:
+		ioError = patterns.WriteCells(file, p)
+	}
+	util.Check(ioError)
+
+	ioError = file.Sync()
+	util.Check(ioError)
+
+	if io.params.PNG {
+		util.Check(io.writePNG(filename, world))
+	}
+
+	fmt.Println("File", filename, "output done!")
+}
+
+// readPattern opens an RLE, .cells or .mc pattern file, places the pattern in the middle of an empty
+// world, moved by params.Offset, and sends the rule the file names followed by the world a row at a
+// time. It is the pattern's alive cells that are placed in the middle, whatever size the file gives it.
+func (io *ioState) readPattern() {
+
+	// Request the path of the pattern from the distributor.
+	filename := <-io.channels.filename
+
+	data, ioError := os.ReadFile(filename)
+	util.Check(ioError)
+
+	// Only the alive cells need to fit, as the dead ones around them wrap onto each other harmlessly
+	height, width := io.params.ImageHeight, io.params.ImageWidth
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	var p patterns.Pattern
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".rle":
+		p, err = patterns.ParseRLE(name, string(data))
+	case ".mc":
+		p, err = patterns.ParseMacrocell(name, string(data), width, height)
+	default:
+		p, err = patterns.Parse(name, string(data))
+	}
+	util.Check(err)
+
+	minX, minY, extentX, extentY := p.Bounds()
+	if extentX > width || extentY > height {
+		panic(fmt.Sprintf("Pattern %v is %dx%d, too big for a %dx%d world", p.Name, extentX, extentY, width, height))
+	}
+	world, _ := patterns.Compose(height, width)
+	// Centre the alive cells rather than the pattern's size, which for a macrocell is the whole square
+	// of its quadtree, so that none are lost off an edge the topology does not join up
+	x := width/2 - extentX/2 - minX + io.params.Offset.X
+	y := height/2 - extentY/2 - minY + io.params.Offset.Y
+	patterns.Stamp(world, p, x, y)
+
+	io.channels.rule <- p.Rule
+	for _, row := range world {
+		io.channels.input <- row
 	}
 
 	fmt.Println("File", filename, "input done!")
 }
 
+// ImageSize reads the width and height of the world stored in a pbm or pgm image from its header.
+func ImageSize(path string) (width, height int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, width, height, err = netpbmSize(path, data)
+	return width, height, err
+}
+
 // startIo should be the entrypoint of the io goroutine.
 func startIo(p Params, c ioChannels) {
 	io := ioState{
@@ -135,9 +228,13 @@ func startIo(p Params, c ioChannels) {
 		// Block and wait for requests from the distributor
 		switch command {
 		case ioInput:
-			io.readPgmImage()
+			io.readImage()
 		case ioOutput:
-			io.writePgmImage()
+			io.writeImage()
+		case ioPatternInput:
+			io.readPattern()
+		case ioPatternOutput:
+			io.writePattern()
 		case ioCheckIdle:
 			io.channels.idle <- true
 		}
@@ -0,0 +1,286 @@
+package gol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The Netpbm formats worlds are read from and written to, by magic number. Greymaps store each cell as a
+// grey level, white for alive; bitmaps store a single bit, 1 (black) for alive. The plain formats write
+// the cells out as text and the raw ones as bytes.
+const (
+	plainPBM = "P1"
+	plainPGM = "P2"
+	rawPBM   = "P4"
+	rawPGM   = "P5"
+)
+
+// netpbmExtensions lists the formats an image with each file extension may be in.
+var netpbmExtensions = map[string][]string{
+	".pbm": {plainPBM, rawPBM},
+	".pgm": {plainPGM, rawPGM},
+	".pnm": {plainPBM, plainPGM, rawPBM, rawPGM},
+}
+
+// outputFormat gives the extension of the images the world is saved to and the Netpbm format written
+// under it, which is empty for the pattern formats.
+func (p Params) outputFormat() (string, string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(p.Output, "."))
+	switch ext {
+	case "", "pgm":
+		if p.Plain {
+			return "pgm", plainPGM, nil
+		}
+		return "pgm", rawPGM, nil
+	case "pbm":
+		if p.Plain {
+			return "pbm", plainPBM, nil
+		}
+		return "pbm", rawPBM, nil
+	case "rle", "cells", "mc":
+		return ext, "", nil
+	}
+	return "", "", fmt.Errorf("unknown output format %q: expected pgm, pbm, rle, cells or mc", p.Output)
+}
+
+// netpbmHeader splits a Netpbm image into the fields of its header, skipping comments, and the data
+// that follows the single whitespace character after them. Bitmaps have no maxval, so have one field fewer.
+func netpbmHeader(data []byte) ([]string, []byte) {
+	var fields []string
+	i := 0
+	for (len(fields) < 3 || len(fields) < 4 && !isBitmap(fields[0])) && i < len(data) {
+		switch {
+		case data[i] == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case isSpace(data[i]):
+			i++
+		default:
+			start := i
+			for i < len(data) && !isSpace(data[i]) && data[i] != '#' {
+				i++
+			}
+			fields = append(fields, string(data[start:i]))
+		}
+	}
+	if i < len(data) {
+		i++
+	}
+	return fields, data[i:]
+}
+
+func isBitmap(magic string) bool {
+	return magic == plainPBM || magic == rawPBM
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+// netpbmSize reads the format and size of a Netpbm image from its header, checking that the format is
+// one its file extension allows.
+func netpbmSize(path string, data []byte) (magic string, width, height int, err error) {
+	header, _ := netpbmHeader(data)
+	if len(header) < 3 {
+		return "", 0, 0, fmt.Errorf("%v is not a Netpbm image", path)
+	}
+	allowed, ok := netpbmExtensions[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return "", 0, 0, fmt.Errorf("%v is not a .pbm, .pgm or .pnm image", path)
+	}
+	magic = header[0]
+	if !contains(allowed, magic) {
+		return "", 0, 0, fmt.Errorf("%v has magic number %v: expected one of %v", path, magic, strings.Join(allowed, ", "))
+	}
+	width, err = strconv.Atoi(header[1])
+	if err != nil || width <= 0 {
+		return "", 0, 0, fmt.Errorf("%v has an invalid width", path)
+	}
+	height, err = strconv.Atoi(header[2])
+	if err != nil || height <= 0 {
+		return "", 0, 0, fmt.Errorf("%v has an invalid height", path)
+	}
+	return magic, width, height, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeNetpbm reads the cells of a world from a Netpbm image, one row after another. Greymaps with a
+// maxval of 255 are the worlds' own format, so their grey levels are kept as they are; other maxvals are
+// thresholded, with cells brighter than half the maxval alive.
+func decodeNetpbm(path string, data []byte) (width, height int, cells []byte, err error) {
+	magic, width, height, err := netpbmSize(path, data)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	header, image := netpbmHeader(data)
+	maxval := 1
+	if !isBitmap(magic) {
+		if len(header) < 4 {
+			return 0, 0, nil, fmt.Errorf("%v has no maxval", path)
+		}
+		maxval, err = strconv.Atoi(header[3])
+		if err != nil || maxval <= 0 || maxval > 65535 {
+			return 0, 0, nil, fmt.Errorf("%v has an invalid maxval", path)
+		}
+	}
+	level := func(v int) byte {
+		if maxval == 255 {
+			return byte(v)
+		}
+		if 2*v > maxval {
+			return 255
+		}
+		return 0
+	}
+
+	cells = make([]byte, 0, width*height)
+	switch magic {
+	case rawPGM:
+		size := 1
+		if maxval > 255 {
+			size = 2
+		}
+		if len(image) < width*height*size {
+			return 0, 0, nil, fmt.Errorf("%v is too short for a %dx%d image", path, width, height)
+		}
+		for i := 0; i < width*height; i++ {
+			v := int(image[i])
+			if size == 2 {
+				v = int(image[2*i])<<8 | int(image[2*i+1])
+			}
+			cells = append(cells, level(v))
+		}
+	case rawPBM:
+		stride := (width + 7) / 8
+		if len(image) < stride*height {
+			return 0, 0, nil, fmt.Errorf("%v is too short for a %dx%d image", path, width, height)
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				cells = append(cells, image[y*stride+x/8]>>(7-x%8)&1*255)
+			}
+		}
+	default:
+		// The plain formats list the cells as numbers between whitespace and comments. Bitmaps need
+		// no whitespace, as every cell is a single digit.
+		for i := 0; len(cells) < width*height; {
+			for i < len(image) && (isSpace(image[i]) || image[i] == '#') {
+				if image[i] == '#' {
+					for i < len(image) && image[i] != '\n' {
+						i++
+					}
+				} else {
+					i++
+				}
+			}
+			if i == len(image) {
+				return 0, 0, nil, fmt.Errorf("%v is too short for a %dx%d image", path, width, height)
+			}
+			start := i
+			for i < len(image) && image[i] >= '0' && image[i] <= '9' && (i == start || magic == plainPGM) {
+				i++
+			}
+			v, err := strconv.Atoi(string(image[start:i]))
+			if err != nil || v > maxval {
+				return 0, 0, nil, fmt.Errorf("%v has an invalid value at cell %v", path, len(cells))
+			}
+			cells = append(cells, level(v))
+		}
+	}
+	return width, height, cells, nil
+}
+
+// maxLine is the longest line the plain formats are written with, as Netpbm asks.
+const maxLine = 70
+
+// netpbmEncoder writes the cells of a world as a Netpbm image a row at a time, through a buffer, so that
+// huge worlds need not be held twice over or written a cell at a time.
+type netpbmEncoder struct {
+	b       *bufio.Writer
+	magic   string
+	width   int
+	scratch []byte // Space to pack a row of a raw bitmap or format a plain value in
+}
+
+// newNetpbmEncoder writes the header of a Netpbm image in the given format, with a comment unless it is
+// empty, ready for the rows to follow.
+func newNetpbmEncoder(w io.Writer, magic string, width, height int, comment string) *netpbmEncoder {
+	e := &netpbmEncoder{b: bufio.NewWriterSize(w, 1<<16), magic: magic, width: width}
+	fmt.Fprintln(e.b, magic)
+	if comment != "" {
+		fmt.Fprintln(e.b, "#", comment)
+	}
+	fmt.Fprintln(e.b, width, height)
+	if !isBitmap(magic) {
+		fmt.Fprintln(e.b, 255)
+	}
+	return e
+}
+
+// writeRow writes the next row of cells. Greymaps keep every grey level, while bitmaps only keep which
+// cells are alive.
+func (e *netpbmEncoder) writeRow(row []byte) {
+	switch e.magic {
+	case rawPGM:
+		e.b.Write(row)
+	case rawPBM:
+		packed := e.scratch[:0]
+		for i := 0; i < (e.width+7)/8; i++ {
+			packed = append(packed, 0)
+		}
+		for x, cell := range row {
+			if cell == 255 {
+				packed[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+		e.b.Write(packed)
+		e.scratch = packed
+	default:
+		// One row to a line, broken up where it would run past maxLine
+		line := 0
+		for _, cell := range row {
+			value := e.scratch[:0]
+			switch {
+			case e.magic == plainPBM && cell == 255:
+				value = append(value, '1')
+			case e.magic == plainPBM:
+				value = append(value, '0')
+			default:
+				value = strconv.AppendInt(value, int64(cell), 10)
+			}
+			e.scratch = value
+			separator := 0
+			if line > 0 && e.magic == plainPGM {
+				separator = 1
+			}
+			if line+separator+len(value) > maxLine {
+				e.b.WriteByte('\n')
+				line, separator = 0, 0
+			}
+			if separator > 0 {
+				e.b.WriteByte(' ')
+			}
+			e.b.Write(value)
+			line += separator + len(value)
+		}
+		e.b.WriteByte('\n')
+	}
+}
+
+// flush writes out what is left in the buffer once every row has been written.
+func (e *netpbmEncoder) flush() error {
+	return e.b.Flush()
+}
@@ -0,0 +1,181 @@
+package gol
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// netpbmWorld gives a world of random cells, with grey levels as well as alive and dead cells if grey is set.
+func netpbmWorld(rng *rand.Rand, width, height int, grey bool) [][]byte {
+	world := make([][]byte, height)
+	for y := range world {
+		world[y] = make([]byte, width)
+		for x := range world[y] {
+			switch {
+			case grey:
+				world[y][x] = byte(rng.Intn(256))
+			case rng.Intn(3) == 0:
+				world[y][x] = 255
+			}
+		}
+	}
+	return world
+}
+
+// encodeWorld writes a world as a Netpbm image in the given format.
+func encodeWorld(t *testing.T, magic string, world [][]byte, comment string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	e := newNetpbmEncoder(&b, magic, len(world[0]), len(world), comment)
+	for _, row := range world {
+		e.writeRow(row)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// checkCells compares the cells read from an image with a world, which bitmaps only keep the alive cells of.
+func checkCells(t *testing.T, magic string, world [][]byte, width, height int, cells []byte) {
+	t.Helper()
+	if width != len(world[0]) || height != len(world) {
+		t.Fatalf("read as %dx%d, expected %dx%d", width, height, len(world[0]), len(world))
+	}
+	for y, row := range world {
+		for x, cell := range row {
+			if isBitmap(magic) && cell != 255 {
+				cell = 0
+			}
+			if got := cells[y*width+x]; got != cell {
+				t.Fatalf("cell (%v, %v) read as %v, expected %v", x, y, got, cell)
+			}
+		}
+	}
+}
+
+// TestNetpbmRoundTrip tests that worlds written in each format read back the same, with rows that do
+// not fill a whole byte of a bitmap and rows too long for a single line of the plain formats.
+func TestNetpbmRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, magic := range []string{plainPBM, plainPGM, rawPBM, rawPGM} {
+		for _, size := range [][2]int{{1, 1}, {13, 5}, {100, 30}} {
+			width, height := size[0], size[1]
+			t.Run(fmt.Sprintf("%v/%dx%d", magic, width, height), func(t *testing.T) {
+				world := netpbmWorld(rng, width, height, !isBitmap(magic))
+				data := encodeWorld(t, magic, world, "turn 12 of 34")
+				w, h, cells, err := decodeNetpbm("world.pnm", data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkCells(t, magic, world, w, h, cells)
+			})
+		}
+	}
+}
+
+// TestNetpbmLineLength tests that no line of a plain image runs past 70 characters, however wide the world.
+func TestNetpbmLineLength(t *testing.T) {
+	world := netpbmWorld(rand.New(rand.NewSource(2)), 211, 4, true)
+	for x := range world[0] {
+		world[0][x] = 255
+	}
+	for _, magic := range []string{plainPBM, plainPGM} {
+		data := encodeWorld(t, magic, world, "")
+		for i, line := range strings.Split(string(data), "\n") {
+			if len(line) > maxLine {
+				t.Errorf("%v: line %v is %v characters long", magic, i+1, len(line))
+			}
+		}
+	}
+}
+
+// TestNetpbmRawWhitespace tests raw images whose data starts with and holds bytes that are whitespace in
+// the header, which must be read as cells rather than skipped.
+func TestNetpbmRawWhitespace(t *testing.T) {
+	greys := [][]byte{{'\n', ' ', '\t', '\r'}, {'\v', '\f', '#', 0}}
+	data := encodeWorld(t, rawPGM, greys, "")
+	_, _, cells, err := decodeNetpbm("world.pgm", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCells(t, rawPGM, greys, 4, 2, cells)
+
+	// Rows that pack into a newline (00001010) and a space (00100000)
+	bits := [][]byte{{0, 0, 0, 0, 255, 0, 255, 0}, {0, 0, 255, 0, 0, 0, 0, 0}}
+	data = encodeWorld(t, rawPBM, bits, "")
+	if !bytes.HasSuffix(data, []byte("8 2\n\n ")) {
+		t.Fatalf("bitmap written as %q", data)
+	}
+	_, _, cells, err = decodeNetpbm("world.pbm", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCells(t, rawPBM, bits, 8, 2, cells)
+}
+
+// TestDecodeNetpbm tests images as other programs may write them, with comments anywhere in the header,
+// plain bitmaps without spaces, and maxvals other than 255, whose levels are thresholded.
+func TestDecodeNetpbm(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		width int
+		cells []byte
+	}{
+		{"comments", "P2\n# made by hand\n3 # width\n# height next\n1\n255\n0 128 255\n", 3, []byte{0, 128, 255}},
+		{"comment after magic", "P1#a bitmap\n2 2\n1 0\n0 1\n", 2, []byte{255, 0, 0, 255}},
+		{"plain bitmap without spaces", "P1\n4 2\n1001\n0110", 4, []byte{255, 0, 0, 255, 0, 255, 255, 0}},
+		{"comments between cells", "P1\n3 1\n1 # first\n0\n# last\n1\n", 3, []byte{255, 0, 255}},
+		{"maxval 1", "P2 4 1 1\n0 1 1 0\n", 4, []byte{0, 255, 255, 0}},
+		{"plain maxval 65535", "P2\n3 1\n65535\n0 32767 32768\n", 3, []byte{0, 0, 255}},
+		{"raw maxval 1", "P5 4 1 1\n\x00\x01\x01\x00", 4, []byte{0, 255, 255, 0}},
+		{"raw maxval 65535", "P5 3 1 65535\n\x00\x0a\x7f\xff\x80\x00", 3, []byte{0, 0, 255}},
+		{"raw bitmap", "P4\n# comment\n10 1\n\xc0\x40", 10, []byte{255, 255, 0, 0, 0, 0, 0, 0, 0, 255}},
+	}
+	for _, test := range tests {
+		width, height, cells, err := decodeNetpbm("test.pnm", []byte(test.data))
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if width != test.width || height != len(test.cells)/test.width || !bytes.Equal(cells, test.cells) {
+			t.Errorf("%v: %dx%d %v, expected %dx%d %v", test.name, width, height, cells,
+				test.width, len(test.cells)/test.width, test.cells)
+		}
+	}
+}
+
+// TestDecodeNetpbmInvalid tests that malformed images, and images in a format their extension does not
+// allow, are refused.
+func TestDecodeNetpbmInvalid(t *testing.T) {
+	tests := []struct {
+		path string
+		data string
+	}{
+		{"a.pnm", ""},
+		{"a.pnm", "P3\n1 1\n255\n0 0 0\n"},
+		{"a.pgm", "P1\n1 1\n1\n"},
+		{"a.pbm", "P5\n1 1\n255\n\x00"},
+		{"a.png", "P1\n1 1\n1\n"},
+		{"a.pnm", "P1\n0 1\n"},
+		{"a.pnm", "P1\n1 x\n1\n"},
+		{"a.pnm", "P2\n1 1\n"},
+		{"a.pnm", "P2\n1 1\n0\n0\n"},
+		{"a.pnm", "P2\n1 1\n65536\n0\n"},
+		{"a.pnm", "P2\n2 1\n1\n1 2\n"},
+		{"a.pnm", "P2\n2 1\n255\n1\n"},
+		{"a.pnm", "P1\n2 1\n1 x\n"},
+		{"a.pnm", "P5\n2 2\n255\n\x00\x00\x00"},
+		{"a.pnm", "P5\n2 1\n65535\n\x00\x00\x00"},
+		{"a.pnm", "P4\n9 2\n\x00\x00\x00"},
+	}
+	for _, test := range tests {
+		if _, _, _, err := decodeNetpbm(test.path, []byte(test.data)); err == nil {
+			t.Errorf("%v %q was accepted", test.path, test.data)
+		}
+	}
+}
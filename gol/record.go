@@ -0,0 +1,323 @@
+package gol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// frameDelay is how long each frame of a recording is shown for.
+const frameDelay = 100 * time.Millisecond
+
+// recorder draws the world every few turns into an animated GIF or PNG. Frames are written out as they
+// are drawn, so that long runs are not held in memory.
+type recorder struct {
+	every   int
+	last    int // Turn last recorded, or -1 before the first frame
+	scale   int
+	palette color.Palette
+	anim    animation
+}
+
+// animation is an animated image file that frames are added to one at a time.
+type animation interface {
+	addFrame(img *image.Paletted) error
+	close() error
+}
+
+// newRecorder creates the file p.Record, picking the format by its extension: .gif for an animated GIF,
+// or .png or .apng for an animated PNG. It gives nil if there is nothing to record.
+func newRecorder(p Params) (*recorder, error) {
+	if p.Record == "" {
+		return nil, nil
+	}
+	palette, err := parsePalette(p.Palette)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{
+		every:   p.RecordEvery,
+		last:    -1,
+		scale:   p.Scale,
+		palette: palette,
+	}
+	if r.every < 1 {
+		r.every = 1
+	}
+	if r.scale < 1 {
+		r.scale = 1
+	}
+
+	ext := strings.ToLower(filepath.Ext(p.Record))
+	if ext != ".gif" && ext != ".png" && ext != ".apng" {
+		return nil, fmt.Errorf("cannot record to %v: expected a .gif, .png or .apng file", p.Record)
+	}
+	width, height := p.ImageWidth*r.scale, p.ImageHeight*r.scale
+	if ext == ".gif" && (width > 65535 || height > 65535) {
+		return nil, fmt.Errorf("cannot record a %dx%d world at scale %v to a GIF, which is at most 65535 pixels a side",
+			p.ImageWidth, p.ImageHeight, r.scale)
+	}
+	file, err := os.Create(p.Record)
+	if err != nil {
+		return nil, err
+	}
+	if ext == ".gif" {
+		r.anim = newGIFWriter(file, width, height, palette, p.generatedComment())
+	} else {
+		r.anim = &apngWriter{file: file, b: bufio.NewWriter(file), comment: p.generatedComment()}
+	}
+	return r, nil
+}
+
+// frame draws the world as of turn into the recording if it is the first turn seen at or after the next
+// multiple of r.every. A nil recorder records nothing.
+func (r *recorder) frame(turn int, world [][]byte) error {
+	if r == nil || r.anim == nil || r.last >= 0 && turn/r.every == r.last/r.every {
+		return nil
+	}
+	r.last = turn
+	return r.anim.addFrame(render(world, r.scale, r.palette))
+}
+
+// close finishes off the recording. It is safe to call more than once.
+func (r *recorder) close() error {
+	if r == nil || r.anim == nil {
+		return nil
+	}
+	err := r.anim.close()
+	r.anim = nil
+	return err
+}
+
+// gifWriter writes an animated GIF a frame at a time, which the standard library's encoder cannot, as it
+// needs every frame at once. Every frame shares the palette as the global colour table.
+type gifWriter struct {
+	file *os.File
+	b    *bufio.Writer
+}
+
+func newGIFWriter(file *os.File, width, height int, palette color.Palette, comment string) *gifWriter {
+	g := &gifWriter{file: file, b: bufio.NewWriter(file)}
+	g.b.WriteString("GIF89a")
+	binary.Write(g.b, binary.LittleEndian, []uint16{uint16(width), uint16(height)})
+	// A global colour table of 256 colours, background colour 0 and square pixels
+	g.b.Write([]byte{0xF7, 0, 0})
+	for _, c := range palette {
+		r, gr, b, _ := c.RGBA()
+		g.b.Write([]byte{byte(r >> 8), byte(gr >> 8), byte(b >> 8)})
+	}
+	// Loop forever
+	g.b.Write([]byte{0x21, 0xFF, 0x0B})
+	g.b.WriteString("NETSCAPE2.0")
+	g.b.Write([]byte{3, 1, 0, 0, 0})
+	if comment != "" {
+		g.b.Write([]byte{0x21, 0xFE})
+		blocks := &gifBlocks{w: g.b}
+		blocks.Write([]byte(comment))
+		blocks.close()
+	}
+	return g
+}
+
+func (g *gifWriter) addFrame(img *image.Paletted) error {
+	delay := uint16(frameDelay / (10 * time.Millisecond))
+	g.b.Write([]byte{0x21, 0xF9, 4, 0, byte(delay), byte(delay >> 8), 0, 0})
+	g.b.WriteByte(0x2C)
+	binary.Write(g.b, binary.LittleEndian, []uint16{0, 0, uint16(img.Rect.Dx()), uint16(img.Rect.Dy())})
+	// No local colour table, then the image data compressed with codes starting at 8 bits
+	g.b.Write([]byte{0, 8})
+	blocks := &gifBlocks{w: g.b}
+	compressor := lzw.NewWriter(blocks, lzw.LSB, 8)
+	_, err := compressor.Write(img.Pix)
+	if err != nil {
+		return err
+	}
+	err = compressor.Close()
+	if err != nil {
+		return err
+	}
+	return blocks.close()
+}
+
+func (g *gifWriter) close() error {
+	g.b.WriteByte(0x3B)
+	err := g.b.Flush()
+	if err != nil {
+		g.file.Close()
+		return err
+	}
+	return g.file.Close()
+}
+
+// gifBlocks splits the compressed image data into the blocks of up to 255 bytes a GIF stores it in.
+type gifBlocks struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+}
+
+func (b *gifBlocks) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		copied := copy(b.buf[b.n:], p)
+		b.n += copied
+		p = p[copied:]
+		if b.n == len(b.buf) {
+			b.flush()
+		}
+	}
+	return written, nil
+}
+
+func (b *gifBlocks) flush() {
+	if b.n > 0 {
+		b.w.WriteByte(byte(b.n))
+		b.w.Write(b.buf[:b.n])
+		b.n = 0
+	}
+}
+
+// close writes out the last block and the empty block that ends the image data.
+func (b *gifBlocks) close() error {
+	b.flush()
+	return b.w.WriteByte(0)
+}
+
+// apngWriter writes an animated PNG a frame at a time, taking the chunks of each frame from the standard
+// library's PNG encoder. The number of frames, which comes before them all, is filled in on close.
+type apngWriter struct {
+	file    *os.File
+	b       *bufio.Writer
+	offset  int64 // Bytes written so far
+	actl    int64 // Where the acTL chunk, which holds the number of frames, starts
+	frames  int
+	seq     uint32 // Sequence number of the next fcTL or fdAT chunk
+	comment string // Written to a tEXt chunk before the first frame, if not empty
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func (a *apngWriter) addFrame(img *image.Paletted) error {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, img)
+	if err != nil {
+		return err
+	}
+
+	first := a.frames == 0
+	if first {
+		a.write(pngSignature)
+	}
+	controlled := false
+	data := encoded.Bytes()[len(pngSignature):]
+	for len(data) >= 12 {
+		length := binary.BigEndian.Uint32(data)
+		kind, body := string(data[4:8]), data[8:8+length]
+		data = data[12+length:]
+		switch kind {
+		case "IHDR":
+			if first {
+				a.chunk(kind, body)
+				// Loop forever; the number of frames is not known yet
+				a.actl = a.offset
+				a.chunk("acTL", make([]byte, 8))
+				if a.comment != "" {
+					a.write(textChunk(a.comment))
+				}
+			}
+		case "IDAT":
+			if !controlled {
+				a.frameControl(img.Rect.Dx(), img.Rect.Dy())
+				controlled = true
+			}
+			if first {
+				a.chunk(kind, body)
+			} else {
+				a.chunk("fdAT", append(a.sequence(), body...))
+			}
+		case "IEND":
+		default:
+			// The palette and any other chunks the encoder writes are the same for every frame
+			if first {
+				a.chunk(kind, body)
+			}
+		}
+	}
+	a.frames++
+	return nil
+}
+
+// frameControl writes the fcTL chunk that starts a frame covering the whole image, shown for frameDelay.
+func (a *apngWriter) frameControl(width, height int) {
+	body := append(a.sequence(), make([]byte, 22)...)
+	binary.BigEndian.PutUint32(body[4:], uint32(width))
+	binary.BigEndian.PutUint32(body[8:], uint32(height))
+	// At (0, 0), shown for the delay as a fraction of a second, replacing the previous frame
+	binary.BigEndian.PutUint16(body[20:], uint16(frameDelay/time.Millisecond))
+	binary.BigEndian.PutUint16(body[22:], 1000)
+	a.chunk("fcTL", body)
+}
+
+// sequence gives the next sequence number, which fcTL and fdAT chunks share, as the start of a chunk.
+func (a *apngWriter) sequence() []byte {
+	body := make([]byte, 4, 64)
+	binary.BigEndian.PutUint32(body, a.seq)
+	a.seq++
+	return body
+}
+
+func (a *apngWriter) write(data []byte) {
+	a.b.Write(data)
+	a.offset += int64(len(data))
+}
+
+// chunk writes a PNG chunk: its length, kind, body and the checksum of the kind and body.
+func (a *apngWriter) chunk(kind string, body []byte) {
+	a.write(pngChunk(kind, body))
+}
+
+func pngChunk(kind string, body []byte) []byte {
+	chunk := make([]byte, 8+len(body)+4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], kind)
+	copy(chunk[8:], body)
+	binary.BigEndian.PutUint32(chunk[8+len(body):], crc32.ChecksumIEEE(chunk[4:8+len(body)]))
+	return chunk
+}
+
+// textChunk gives a tEXt chunk holding comment as the image's Comment.
+func textChunk(comment string) []byte {
+	return pngChunk("tEXt", []byte("Comment\x00"+comment))
+}
+
+// close ends the image and goes back to fill in the number of frames. A PNG must hold an image, so
+// without any frames the file is removed instead.
+func (a *apngWriter) close() error {
+	if a.frames == 0 {
+		a.file.Close()
+		os.Remove(a.file.Name())
+		return fmt.Errorf("no frames were recorded, so %v was not written", a.file.Name())
+	}
+	a.chunk("IEND", nil)
+	err := a.b.Flush()
+	if err == nil {
+		actl := make([]byte, 8)
+		binary.BigEndian.PutUint32(actl, uint32(a.frames))
+		_, err = a.file.WriteAt(pngChunk("acTL", actl), a.actl)
+	}
+	if err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,236 @@
+package gol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordWorlds records a world of random cells, some of them grey, for each of turns 0 to turns-1, and
+// gives the images of the turns that should have been recorded.
+func recordWorlds(t *testing.T, p Params, turns int) []*image.Paletted {
+	t.Helper()
+	rec, err := newRecorder(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	palette, _ := parsePalette(p.Palette)
+	rng := rand.New(rand.NewSource(int64(turns)))
+	var want []*image.Paletted
+	for turn := 0; turn < turns; turn++ {
+		world := netpbmWorld(rng, p.ImageWidth, p.ImageHeight, turn%3 == 0)
+		if err := rec.frame(turn, world); err != nil {
+			t.Fatal(err)
+		}
+		if turn%p.RecordEvery == 0 {
+			want = append(want, render(world, p.Scale, palette))
+		}
+	}
+	if err := rec.close(); err != nil {
+		t.Fatal(err)
+	}
+	return want
+}
+
+// TestRecordGIF tests that recorded GIFs decode to the frames that were drawn, in the palette they were
+// drawn in, including frames whose compressed data spans many blocks, and record how the world was generated.
+func TestRecordGIF(t *testing.T) {
+	for _, size := range [][2]int{{13, 7}, {150, 90}} {
+		path := filepath.Join(t.TempDir(), "world.gif")
+		p := Params{ImageWidth: size[0], ImageHeight: size[1], Record: path, RecordEvery: 2, Scale: 2, Palette: "amber",
+			Generate: "random", Density: 0.3, Seed: 42}
+		want := recordWorlds(t, p, 9)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		comment := p.generatedComment()
+		if extension := append([]byte{0x21, 0xFE, byte(len(comment))}, comment+"\x00"...); !bytes.Contains(data, extension) {
+			t.Errorf("no comment extension %q", extension)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := gif.DecodeAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Image) != len(want) || g.LoopCount != 0 {
+			t.Fatalf("%v frames looping %v times, expected %v looping forever", len(g.Image), g.LoopCount, len(want))
+		}
+		if g.Config.Width != 2*size[0] || g.Config.Height != 2*size[1] {
+			t.Errorf("%dx%d image, expected %dx%d", g.Config.Width, g.Config.Height, 2*size[0], 2*size[1])
+		}
+		for i, img := range g.Image {
+			if g.Delay[i] != 10 {
+				t.Errorf("frame %v is shown for %v hundredths of a second", i, g.Delay[i])
+			}
+			if img.Rect != want[i].Rect || !bytes.Equal(img.Pix, want[i].Pix) {
+				t.Fatalf("frame %v differs from the world drawn", i)
+			}
+			for j, c := range img.Palette {
+				if c != want[i].Palette[j] {
+					t.Fatalf("colour %v is %v, expected %v", j, c, want[i].Palette[j])
+				}
+			}
+		}
+	}
+}
+
+type pngChunkData struct {
+	kind string
+	body []byte
+}
+
+// readChunks splits a PNG into its chunks, checking the signature and the checksum of every chunk.
+func readChunks(t *testing.T, data []byte) []pngChunkData {
+	t.Helper()
+	if !bytes.HasPrefix(data, pngSignature) {
+		t.Fatal("no PNG signature")
+	}
+	data = data[len(pngSignature):]
+	var chunks []pngChunkData
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%v bytes left over after %v chunks", len(data), len(chunks))
+		}
+		length := int(binary.BigEndian.Uint32(data))
+		if len(data) < 12+length {
+			t.Fatalf("chunk %v runs past the end of the file", len(chunks))
+		}
+		kind, body := string(data[4:8]), data[8:8+length]
+		if crc := binary.BigEndian.Uint32(data[8+length:]); crc != crc32.ChecksumIEEE(data[4:8+length]) {
+			t.Fatalf("chunk %v (%v) has the wrong checksum", len(chunks), kind)
+		}
+		chunks = append(chunks, pngChunkData{kind, body})
+		data = data[12+length:]
+	}
+	return chunks
+}
+
+// TestRecordAPNG tests the chunks of recorded animated PNGs: the number of frames filled in, the sequence
+// numbers of the frames' chunks, the comment saying how the world was generated, and that each frame
+// decodes to the world drawn.
+func TestRecordAPNG(t *testing.T) {
+	for _, name := range []string{"world.png", "world.apng"} {
+		path := filepath.Join(t.TempDir(), name)
+		p := Params{ImageWidth: 40, ImageHeight: 30, Record: path, RecordEvery: 3, Scale: 3, Palette: "green",
+			Generate: "soup", Symmetry: "D4", Seed: 7}
+		want := recordWorlds(t, p, 10)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := readChunks(t, data)
+		if chunks[0].kind != "IHDR" || chunks[1].kind != "acTL" || chunks[len(chunks)-1].kind != "IEND" {
+			t.Fatalf("%v: starts with %v and %v and ends with %v", name, chunks[0].kind, chunks[1].kind, chunks[len(chunks)-1].kind)
+		}
+		if frames, plays := binary.BigEndian.Uint32(chunks[1].body), binary.BigEndian.Uint32(chunks[1].body[4:]); frames != uint32(len(want)) || plays != 0 {
+			t.Errorf("%v: acTL gives %v frames played %v times, expected %v played forever", name, frames, plays, len(want))
+		}
+
+		// Rebuild each frame as a PNG of its own, from the chunks before the first frame and its image data
+		header := []pngChunkData{chunks[0]}
+		var frames [][]byte
+		seq := uint32(0)
+		for _, c := range chunks[2 : len(chunks)-1] {
+			switch c.kind {
+			case "fcTL", "fdAT":
+				if got := binary.BigEndian.Uint32(c.body); got != seq {
+					t.Fatalf("%v: %v has sequence number %v, expected %v", name, c.kind, got, seq)
+				}
+				seq++
+			}
+			switch c.kind {
+			case "fcTL":
+				if w, h := binary.BigEndian.Uint32(c.body[4:]), binary.BigEndian.Uint32(c.body[8:]); w != 120 || h != 90 {
+					t.Errorf("%v: frame %v is %vx%v", name, len(frames), w, h)
+				}
+				frames = append(frames, nil)
+			case "IDAT":
+				if len(frames) != 1 {
+					t.Fatalf("%v: IDAT in frame %v", name, len(frames)-1)
+				}
+				frames[0] = append(frames[0], pngChunk("IDAT", c.body)...)
+			case "fdAT":
+				if len(frames) < 2 {
+					t.Fatalf("%v: fdAT in the first frame", name)
+				}
+				frames[len(frames)-1] = append(frames[len(frames)-1], pngChunk("IDAT", c.body[4:])...)
+			default:
+				if len(frames) > 0 {
+					t.Fatalf("%v: %v after the first frame has started", name, c.kind)
+				}
+				header = append(header, c)
+			}
+		}
+		if len(frames) != len(want) {
+			t.Fatalf("%v: %v frames, expected %v", name, len(frames), len(want))
+		}
+		commented := false
+		for _, c := range header {
+			commented = commented || c.kind == "tEXt" && string(c.body) == "Comment\x00"+p.generatedComment()
+		}
+		if !commented {
+			t.Errorf("%v: no tEXt chunk with the comment %q", name, p.generatedComment())
+		}
+		for i, frame := range frames {
+			still := append([]byte(nil), pngSignature...)
+			for _, c := range header {
+				still = append(still, pngChunk(c.kind, c.body)...)
+			}
+			still = append(append(still, frame...), pngChunk("IEND", nil)...)
+			img, err := png.Decode(bytes.NewReader(still))
+			if err != nil {
+				t.Fatalf("%v: frame %v: %v", name, i, err)
+			}
+			if paletted, ok := img.(*image.Paletted); !ok || !bytes.Equal(paletted.Pix, want[i].Pix) {
+				t.Fatalf("%v: frame %v differs from the world drawn", name, i)
+			}
+		}
+	}
+}
+
+// TestRecordNothing tests that an animated PNG nothing was recorded to is removed rather than left broken,
+// while a GIF without frames is still a valid image.
+func TestRecordNothing(t *testing.T) {
+	dir := t.TempDir()
+	pngRec, err := newRecorder(Params{ImageWidth: 16, ImageHeight: 16, Record: filepath.Join(dir, "empty.png")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pngRec.close(); err == nil {
+		t.Error("empty.png closed without an error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "empty.png")); !os.IsNotExist(err) {
+		t.Errorf("empty.png was left behind: %v", err)
+	}
+
+	gifRec, err := newRecorder(Params{ImageWidth: 16, ImageHeight: 16, Record: filepath.Join(dir, "empty.gif")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gifRec.close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filepath.Join(dir, "empty.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := gif.DecodeConfig(file); err != nil {
+		t.Errorf("empty.gif: %v", err)
+	}
+}
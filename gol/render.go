@@ -0,0 +1,115 @@
+package gol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// palettes are the named colour schemes images can be drawn in, as the colours of dead and alive cells.
+var palettes = map[string][2]color.RGBA{
+	"grey":  {{0, 0, 0, 255}, {255, 255, 255, 255}},
+	"paper": {{255, 255, 255, 255}, {0, 0, 0, 255}},
+	"green": {{0, 16, 0, 255}, {51, 255, 102, 255}},
+	"amber": {{16, 8, 0, 255}, {255, 176, 0, 255}},
+}
+
+// parsePalette reads the colours images are drawn in, either a name from palettes or the colours of dead
+// and alive cells as "#rrggbb,#rrggbb". There is a colour for every grey level a cell can be stored as,
+// so that the cells of rules with more than two states fade from the alive colour to the dead one as they
+// decay. An empty string gives grey, which draws cells as they are stored.
+func parsePalette(s string) (color.Palette, error) {
+	if s == "" {
+		s = "grey"
+	}
+	ends, ok := palettes[strings.ToLower(s)]
+	if !ok {
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unknown palette %q: expected grey, paper, green, amber or #rrggbb,#rrggbb", s)
+		}
+		for i, part := range parts {
+			rgb, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(part), "#"), 16, 32)
+			if err != nil || len(strings.TrimPrefix(strings.TrimSpace(part), "#")) != 6 {
+				return nil, fmt.Errorf("invalid colour %q in palette: expected #rrggbb", part)
+			}
+			ends[i] = color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}
+		}
+	}
+
+	dead, alive := ends[0], ends[1]
+	blend := func(from, to uint8, grey int) uint8 {
+		return uint8((int(from)*(255-grey) + int(to)*grey + 127) / 255)
+	}
+	palette := make(color.Palette, 256)
+	for grey := range palette {
+		palette[grey] = color.RGBA{
+			blend(dead.R, alive.R, grey),
+			blend(dead.G, alive.G, grey),
+			blend(dead.B, alive.B, grey),
+			255,
+		}
+	}
+	return palette, nil
+}
+
+// render draws the cells of a world as squares scale pixels a side. Each cell's grey level picks its
+// colour from the palette.
+func render(world [][]byte, scale int, palette color.Palette) *image.Paletted {
+	if scale < 1 {
+		scale = 1
+	}
+	width := 0
+	if len(world) > 0 {
+		width = len(world[0])
+	}
+	img := image.NewPaletted(image.Rect(0, 0, width*scale, len(world)*scale), palette)
+	for y, cells := range world {
+		row := img.Pix[y*scale*img.Stride : y*scale*img.Stride+width*scale]
+		for x, cell := range cells {
+			for i := 0; i < scale; i++ {
+				row[x*scale+i] = cell
+			}
+		}
+		// The other rows of pixels for the row of cells are the same
+		for i := 1; i < scale; i++ {
+			copy(img.Pix[(y*scale+i)*img.Stride:], row)
+		}
+	}
+	return img
+}
+
+// writePNG saves a world to out/filename.png, drawn as params.Scale and params.Palette say.
+func (io *ioState) writePNG(filename string, world [][]byte) error {
+	palette, err := parsePalette(io.params.Palette)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create("out/" + filename + ".png")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, render(world, io.params.Scale, palette))
+	if err != nil {
+		return err
+	}
+	data := encoded.Bytes()
+	if comment := io.params.generatedComment(); comment != "" {
+		// Record how the world was generated in a tEXt chunk straight after the IHDR chunk
+		header := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+		data = append(append(append([]byte(nil), data[:header]...), textChunk(comment)...), data[header:]...)
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,123 @@
+package gol
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/engine"
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// streamTurns relays the turns the server completes after turn as CellsFlipped (or CellsChanged, for rules
+// with more than two states) and TurnComplete events, until the session finishes or done is closed.
+// world is the world as of turn; it is kept up to date so that the changed cells can be worked out when
+// the server sends a whole world instead, and so that rec can record it. Every turn has its own
+// TurnComplete, but while the viewer is behind, the cells changed over several turns are sent as a single
+// event and the turns in between are not recorded. Only when the server no longer has the turns the
+// viewer missed, or jumps many turns at once with HashLife, is a single TurnComplete sent for them all.
+func streamTurns(client *rpc.Client, session, turn int, world [][]byte, multiState bool, rec *recorder, c distributorChannels, done <-chan bool) {
+	record := func(turn int) {
+		if err := rec.frame(turn, world); err != nil {
+			fmt.Println("Cannot record:", err)
+			rec.close()
+		}
+	}
+	record(turn)
+
+	for {
+		// Hold off while the viewer is falling behind, so that the turns it has missed can be skipped
+		behind := false
+		for len(c.events) > cap(c.events)/2 {
+			behind = true
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-done:
+				return
+			}
+		}
+
+		request := stubs.ChangesRequest{Session: session, Since: turn}
+		response := new(stubs.ChangesResponse)
+		call := client.Go(stubs.ChangesHandler, request, response, nil)
+		select {
+		case <-call.Done:
+		case <-done:
+			return
+		}
+		if call.Error != nil {
+			fmt.Println("Error in Changes RPC call:", call.Error)
+			return
+		}
+
+		switch {
+		case response.World != nil:
+			// The server no longer has every turn we missed, so jump straight to its latest one
+			cells, greys := engine.ChangedCells(world, response.World, 0)
+			c.events <- cellsEvent(response.Turn, cells, greys, multiState)
+			c.events <- TurnComplete{response.Turn}
+			world = response.World
+			record(response.Turn)
+		case behind && len(response.Frames) > 1:
+			// Send the cells changed across all the frames at once, but still complete every turn
+			cells, greys := mergeFrames(world, response.Frames)
+			c.events <- cellsEvent(response.Frames[0].Turn, cells, greys, multiState)
+			for _, frame := range response.Frames {
+				c.events <- TurnComplete{frame.Turn}
+			}
+			record(response.Turn)
+		default:
+			for _, frame := range response.Frames {
+				setCells(world, frame.Cells, frame.Greys)
+				c.events <- cellsEvent(frame.Turn, frame.Cells, frame.Greys, multiState)
+				c.events <- TurnComplete{frame.Turn}
+				record(frame.Turn)
+			}
+		}
+		turn = response.Turn
+
+		if response.Finished {
+			return
+		}
+	}
+}
+
+// cellsEvent describes cells that have changed during a turn, as CellsFlipped for two-state rules
+// and as CellsChanged otherwise.
+func cellsEvent(turn int, cells []util.Cell, greys []byte, multiState bool) Event {
+	if multiState {
+		return CellsChanged{turn, cells, greys}
+	}
+	return CellsFlipped{turn, cells}
+}
+
+// setCells applies a turn's changed cells to the world.
+func setCells(world [][]byte, cells []util.Cell, greys []byte) {
+	for i, cell := range cells {
+		world[cell.Y][cell.X] = greys[i]
+	}
+}
+
+// mergeFrames applies several turns' changed cells to the world and returns the cells that
+// have changed across all of them, along with their grey levels.
+func mergeFrames(world [][]byte, frames []stubs.Frame) ([]util.Cell, []byte) {
+	before := make(map[util.Cell]byte)
+	for _, frame := range frames {
+		for i, cell := range frame.Cells {
+			if _, ok := before[cell]; !ok {
+				before[cell] = world[cell.Y][cell.X]
+			}
+			world[cell.Y][cell.X] = frame.Greys[i]
+		}
+	}
+	var cells []util.Cell
+	var greys []byte
+	for cell, grey := range before {
+		if world[cell.Y][cell.X] != grey {
+			cells = append(cells, cell)
+			greys = append(greys, world[cell.Y][cell.X])
+		}
+	}
+	return cells, greys
+}
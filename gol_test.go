@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"testing"
 
+	"uk.ac.bris.cs/gameoflife/engine"
+	"uk.ac.bris.cs/gameoflife/generate"
 	"uk.ac.bris.cs/gameoflife/gol"
 	"uk.ac.bris.cs/gameoflife/util"
 )
@@ -42,3 +44,36 @@ func TestGol(t *testing.T) {
 		}
 	}
 }
+
+// TestGolNonSquare tests a 70x48 world generated from a seed on 0, 1 and 30 turns, against the engine
+// evolving the same world on its own.
+func TestGolNonSquare(t *testing.T) {
+	options := generate.Options{Generator: "random", Density: 0.3, Seed: 42}
+	p := gol.Params{ImageWidth: 70, ImageHeight: 48, Generate: options.Generator, Density: options.Density, Seed: options.Seed}
+	initial, err := generate.World(options, p.ImageHeight, p.ImageWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, _ := engine.ParseRule(engine.DefaultRule)
+	for _, turns := range []int{0, 1, 30} {
+		p.Turns = turns
+		world := initial
+		for turn := 0; turn < turns; turn++ {
+			world = engine.NextWorld(world, p.ImageHeight, p.ImageWidth, rule, engine.Torus)
+		}
+		expectedAlive := engine.FindAliveCells(world)
+		testName := fmt.Sprintf("%dx%dx%d", p.ImageWidth, p.ImageHeight, p.Turns)
+		t.Run(testName, func(t *testing.T) {
+			events := make(chan gol.Event)
+			go gol.Run(p, events, nil)
+			var cells []util.Cell
+			for event := range events {
+				switch e := event.(type) {
+				case gol.FinalTurnComplete:
+					cells = e.Alive
+				}
+			}
+			assertEqualBoard(t, cells, expectedAlive, p)
+		})
+	}
+}
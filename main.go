@@ -6,9 +6,11 @@ import (
 	"runtime"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/patterns"
 	"uk.ac.bris.cs/gameoflife/sdl"
 )
 
@@ -35,12 +37,139 @@ func main() {
 		512,
 		"Specify the height of the image. Defaults to 512.")
 
+	flag.StringVar(
+		&params.Input,
+		"input",
+		"",
+		"Specify the PBM or PGM image to load the world from, whose size is used unless -w or -h is given, "+
+			"or an RLE, .cells or macrocell .mc pattern to place in an empty world, whose rule is used unless -rule is given. Defaults to images/WxH.pgm.")
+
+	offset := flag.String(
+		"offset",
+		"0,0",
+		"Specify how far from the middle of the world to place a pattern loaded with -input, as x,y. Defaults to 0,0, centred.")
+
+	flag.StringVar(
+		&params.Output,
+		"output",
+		"pgm",
+		"Specify the format of the images saved to out/: pgm (greys, alive cells white), pbm (bits, alive cells black), "+
+			"or the pattern formats rle, cells or mc (macrocell, compact for huge sparse worlds), which cannot be used with Generations rules. Defaults to pgm.")
+
+	flag.BoolVar(
+		&params.Plain,
+		"plain",
+		false,
+		"Save images in the plain Netpbm formats, P1 and P2, which write the cells out as text.")
+
+	flag.BoolVar(
+		&params.PNG,
+		"png",
+		false,
+		"Also save a PNG of the world to out/ whenever an image is saved, when s is pressed and at the end.")
+
+	flag.StringVar(
+		&params.Record,
+		"record",
+		"",
+		"Record the run to an animated GIF (.gif) or PNG (.png or .apng) file as it goes on.")
+
+	flag.IntVar(
+		&params.RecordEvery,
+		"record-every",
+		1,
+		"Specify how many turns apart the frames of a recording are. Defaults to 1, every turn.")
+
+	flag.IntVar(
+		&params.Scale,
+		"scale",
+		1,
+		"Specify how many pixels a side each cell is drawn as in PNGs and recordings. Defaults to 1.")
+
+	flag.StringVar(
+		&params.Palette,
+		"palette",
+		"grey",
+		"Specify the colours of PNGs and recordings: grey, paper, green, amber, or the dead and alive colours as #rrggbb,#rrggbb. Defaults to grey.")
+
 	flag.IntVar(
 		&params.Turns,
 		"turns",
 		10000000000,
 		"Specify the number of turns to process. Defaults to 10000000000.")
 
+	flag.StringVar(
+		&params.Server,
+		"server",
+		gol.DefaultServer,
+		"Specify the address of the Game of Life server. Defaults to "+gol.DefaultServer+".")
+
+	fallbacks := flag.String(
+		"fallback",
+		"",
+		"Specify a comma-separated list of servers to try in order if the server cannot be reached.")
+
+	flag.BoolVar(
+		&params.Attach,
+		"attach",
+		false,
+		"Attach to the simulation already running on the server instead of starting a new one. Its size, rule and topology are used.")
+
+	flag.IntVar(
+		&params.Session,
+		"session",
+		0,
+		"Specify the session to attach to. Defaults to the most recently started one.")
+
+	flag.StringVar(
+		&params.Restore,
+		"restore",
+		"",
+		"Specify a checkpoint file to resume from instead of loading the input image.")
+
+	flag.StringVar(
+		&params.Rule,
+		"rule",
+		"",
+		"Specify the rule set in Birth/Survival or Larger than Life notation, e.g. B36/S23 or R5,C0,M1,S34..58,B34..45,NM. Defaults to B3/S23, or the rule of the checkpoint being restored.")
+
+	flag.StringVar(
+		&params.Topology,
+		"topology",
+		"",
+		"Specify the surface the world is drawn on: torus, plane, cylinder, klein-bottle or cross-surface. Defaults to torus, or the topology of the checkpoint being restored.")
+
+	flag.StringVar(
+		&params.Generate,
+		"generate",
+		"",
+		"Generate the initial world instead of loading an image: random, soup (random with a symmetry), noise (blobs) or patterns (from the pattern library).")
+
+	flag.StringVar(
+		&params.Symmetry,
+		"symmetry",
+		"",
+		"Specify the symmetry of a generated soup: C1, C2, C4, D2, D4 or D8. Defaults to C1, no symmetry.")
+
+	flag.Float64Var(
+		&params.Density,
+		"density",
+		0.5,
+		"Specify the fraction of generated cells that are alive, or for patterns the number placed per 256 cells. Defaults to 0.5.")
+
+	flag.Int64Var(
+		&params.Seed,
+		"seed",
+		0,
+		"Specify the seed for generating the initial world, recorded in the output to repeat a run. Defaults to one picked from the clock.")
+
+	stamps := flag.String(
+		"stamp",
+		"",
+		"Specify a space-separated list of patterns to stamp onto the initial world, or onto the running simulation with -attach, "+
+			"each written as name@x,y with optional /90, /180 or /270 to turn it clockwise and /flip to mirror it, e.g. \"glider@10,10/90 acorn@100,50\". "+
+			"The world is otherwise empty unless an image, generator or checkpoint is given. Patterns: "+strings.Join(patterns.Names(), ", ")+".")
+
 	headless := flag.Bool(
 		"headless",
 		false,
@@ -48,10 +177,54 @@ func main() {
 
 	flag.Parse()
 
+	_, err := fmt.Sscanf(*offset, "%d,%d", &params.Offset.X, &params.Offset.Y)
+	if err != nil {
+		fmt.Println("Invalid offset", *offset+": expected x,y")
+		os.Exit(1)
+	}
+
+	if params.Input != "" && !gol.IsPattern(params.Input) {
+		width, height, err := gol.ImageSize(params.Input)
+		if err != nil {
+			fmt.Println("Error reading input image:", err)
+			os.Exit(1)
+		}
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		if !given["w"] {
+			params.ImageWidth = width
+		}
+		if !given["h"] {
+			params.ImageHeight = height
+		}
+	}
+
+	if params.Attach {
+		// The window must be the size of the running simulation, whatever size was asked for
+		params, err = gol.AttachParams(params)
+		if err != nil {
+			fmt.Println("Error attaching to server:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *stamps != "" {
+		params.Stamps, err = patterns.ParsePlacements(*stamps)
+		if err != nil {
+			fmt.Println("Error reading patterns to stamp:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *fallbacks != "" {
+		params.Fallbacks = strings.Split(*fallbacks, ",")
+	}
+
 	fmt.Printf("%-10v %v\n", "Threads", params.Threads)
 	fmt.Printf("%-10v %v\n", "Width", params.ImageWidth)
 	fmt.Printf("%-10v %v\n", "Height", params.ImageHeight)
 	fmt.Printf("%-10v %v\n", "Turns", params.Turns)
+	fmt.Printf("%-10v %v\n", "Server", params.Server)
 
 	keyPresses := make(chan rune, 10)
 	events := make(chan gol.Event, 1000)
@@ -0,0 +1,137 @@
+// library.go
+package patterns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// library holds the well-known patterns that can be placed by name, drawn in plaintext.
+var library = []struct {
+	name string
+	text string
+}{
+	// Still lifes and oscillators
+	{"block", `
+OO
+OO`},
+	{"beehive", `
+.OO.
+O..O
+.OO.`},
+	{"blinker", `
+OOO`},
+	{"toad", `
+.OOO
+OOO.`},
+	{"beacon", `
+OO..
+OO..
+..OO
+..OO`},
+	{"pulsar", `
+..OOO...OOO..
+.............
+O....O.O....O
+O....O.O....O
+O....O.O....O
+..OOO...OOO..
+.............
+..OOO...OOO..
+O....O.O....O
+O....O.O....O
+O....O.O....O
+.............
+..OOO...OOO..`},
+	{"pentadecathlon", `
+..O....O..
+OO.OOOO.OO
+..O....O..`},
+
+	// Spaceships
+	{"glider", `
+.O.
+..O
+OOO`},
+	{"lwss", `
+.O..O
+O....
+O...O
+OOOO.`},
+	{"mwss", `
+...O..
+.O...O
+O.....
+O....O
+OOOOO.`},
+	{"hwss", `
+...OO..
+.O....O
+O......
+O.....O
+OOOOOO.`},
+
+	// Methuselahs, which take a long time to settle down
+	{"r-pentomino", `
+.OO
+OO.
+.O.`},
+	{"acorn", `
+.O.....
+...O...
+OO..OOO`},
+	{"diehard", `
+......O.
+OO......
+.O...OOO`},
+
+	// Guns and puffers, which grow forever
+	{"gosper-glider-gun", `
+........................O...........
+......................O.O...........
+............OO......OO............OO
+...........O...O....OO............OO
+OO........O.....O...OO..............
+OO........O...O.OO....O.O...........
+..........O.....O.......O...........
+...........O...O....................
+............OO......................`},
+	{"puffer-train", `
+...O.
+....O
+O...O
+.OOOO
+.....
+.....
+.....
+O....
+.OO..
+..O..
+..O..
+.O...
+.....
+.....
+...O.
+....O
+O...O
+.OOOO`},
+}
+
+// Names lists the patterns in the library.
+func Names() []string {
+	names := make([]string, len(library))
+	for i, entry := range library {
+		names[i] = entry.name
+	}
+	return names
+}
+
+// Lookup finds a pattern in the library by name, ignoring case.
+func Lookup(name string) (Pattern, error) {
+	for _, entry := range library {
+		if strings.EqualFold(entry.name, name) {
+			return Parse(entry.name, strings.TrimPrefix(entry.text, "\n"))
+		}
+	}
+	return Pattern{}, fmt.Errorf("unknown pattern %q: expected one of %v", name, strings.Join(Names(), ", "))
+}
@@ -0,0 +1,288 @@
+// macrocell.go
+package patterns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// Golly's macrocell format stores a pattern as a quadtree in which every distinct square appears once,
+// so that huge worlds that are mostly empty or repetitive take up little room. After a "[M2]" header
+// line and # lines, such as "#R B3/S23" giving the rule, each line is one node, numbered from 1:
+//
+//	$.*$..*$***$   a leaf of 8 by 8 cells, row by row, with . dead, * alive and $ ending a row;
+//	               dead cells at the end of a row and empty rows at the end are left out
+//	4 1 0 2 3      a square of 2^4 cells a side made of its nw, ne, sw and se quarters,
+//	               given by node number, with 0 for a quarter with no alive cells
+//
+// The last node is the whole pattern. Golly puts the middle of that square at the origin.
+
+// leafLevel is the level of the leaves of a macrocell quadtree, which are 2^3 = 8 cells a side.
+const leafLevel = 3
+
+// mcNode is a node read from a macrocell file.
+type mcNode struct {
+	level    int
+	children [4]int   // Numbers of the nw, ne, sw and se quarters
+	rows     [8]uint8 // Cells of a leaf, one bit each, with the leftmost cell the lowest bit
+}
+
+// ParseMacrocell reads a pattern in Golly's macrocell format. The pattern is the square the last node
+// covers, so its middle is the origin of the pattern in Golly. A small file can describe a pattern far
+// too big to list the cells of, so the pattern is refused before its cells are listed if its alive
+// cells do not fit within maxWidth by maxHeight.
+func ParseMacrocell(name, text string, maxWidth, maxHeight int) (Pattern, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r", ""), "\n")
+	if !strings.HasPrefix(lines[0], "[M2]") {
+		return Pattern{}, fmt.Errorf("pattern %v: not a macrocell file", name)
+	}
+	p := Pattern{Name: name}
+	nodes := []mcNode{{}} // Node 0 is empty
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#R"):
+			p.Rule = strings.SplitN(strings.TrimSpace(line[2:]), ":", 2)[0]
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line[0] == '.' || line[0] == '*' || line[0] == '$':
+			n := mcNode{level: leafLevel}
+			x, y := 0, 0
+			for _, c := range line {
+				if (c == '.' || c == '*') && (x >= 8 || y >= 8) {
+					return Pattern{}, fmt.Errorf("pattern %v: leaf on line %v is bigger than 8x8", name, i+2)
+				}
+				switch c {
+				case '.':
+					x++
+				case '*':
+					n.rows[y] |= 1 << x
+					x++
+				case '$':
+					x, y = 0, y+1
+				default:
+					return Pattern{}, fmt.Errorf("pattern %v: unexpected %q on line %v", name, c, i+2)
+				}
+			}
+			nodes = append(nodes, n)
+		default:
+			fields := strings.Fields(line)
+			invalid := fmt.Errorf("pattern %v: invalid node on line %v", name, i+2)
+			if len(fields) != 5 {
+				return Pattern{}, invalid
+			}
+			n := mcNode{}
+			var err error
+			if n.level, err = strconv.Atoi(fields[0]); err != nil || n.level <= leafLevel || n.level > 62 {
+				return Pattern{}, invalid
+			}
+			for q := range n.children {
+				child, err := strconv.Atoi(fields[q+1])
+				if err != nil || child < 0 || child >= len(nodes) || child > 0 && nodes[child].level != n.level-1 {
+					return Pattern{}, invalid
+				}
+				n.children[q] = child
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 1 {
+		return Pattern{}, fmt.Errorf("pattern %v: no nodes", name)
+	}
+
+	root := len(nodes) - 1
+	p.Width = 1 << nodes[root].level
+	p.Height = p.Width
+	if box := mcBounds(nodes, root); !box.empty() {
+		width, height := box.maxX-box.minX+1, box.maxY-box.minY+1
+		if width > maxWidth || height > maxHeight {
+			return Pattern{}, fmt.Errorf("pattern %v is %dx%d, too big for %dx%d", name, width, height, maxWidth, maxHeight)
+		}
+	}
+	var visit func(n, x, y int)
+	visit = func(n, x, y int) {
+		node := nodes[n]
+		if node.level == leafLevel {
+			for row, bits := range node.rows {
+				for col := 0; col < 8; col++ {
+					if bits>>col&1 == 1 {
+						p.Cells = append(p.Cells, util.Cell{X: x + col, Y: y + row})
+					}
+				}
+			}
+			return
+		}
+		half := 1 << (node.level - 1)
+		for q, child := range node.children {
+			if child != 0 {
+				visit(child, x+q%2*half, y+q/2*half)
+			}
+		}
+	}
+	visit(root, 0, 0)
+	return p, nil
+}
+
+// mcBox is the smallest rectangle holding the alive cells of a node, relative to its top left corner.
+type mcBox struct {
+	minX, minY, maxX, maxY int
+}
+
+func (b mcBox) empty() bool {
+	return b.minX > b.maxX
+}
+
+// mcBounds works out where the alive cells of a node lie without listing them, visiting each distinct
+// node once however many times it is repeated.
+func mcBounds(nodes []mcNode, root int) mcBox {
+	boxes := make(map[int]mcBox)
+	var bounds func(n int) mcBox
+	bounds = func(n int) mcBox {
+		if box, ok := boxes[n]; ok {
+			return box
+		}
+		box := mcBox{minX: 1, maxX: 0}
+		include := func(other mcBox, x, y int) {
+			if other.empty() {
+				return
+			}
+			other = mcBox{other.minX + x, other.minY + y, other.maxX + x, other.maxY + y}
+			if box.empty() {
+				box = other
+				return
+			}
+			if other.minX < box.minX {
+				box.minX = other.minX
+			}
+			if other.minY < box.minY {
+				box.minY = other.minY
+			}
+			if other.maxX > box.maxX {
+				box.maxX = other.maxX
+			}
+			if other.maxY > box.maxY {
+				box.maxY = other.maxY
+			}
+		}
+		node := nodes[n]
+		switch {
+		case n == 0:
+		case node.level == leafLevel:
+			for y, bits := range node.rows {
+				for x := 0; x < 8; x++ {
+					if bits>>x&1 == 1 {
+						include(mcBox{x, y, x, y}, 0, 0)
+					}
+				}
+			}
+		default:
+			half := 1 << (node.level - 1)
+			for q, child := range node.children {
+				include(bounds(child), q%2*half, q/2*half)
+			}
+		}
+		boxes[n] = box
+		return box
+	}
+	return bounds(root)
+}
+
+// mcWriter numbers the distinct nodes of a quadtree as they are written, so that each is written once.
+type mcWriter struct {
+	b      *bufio.Writer
+	leaves map[[8]uint8]int
+	nodes  map[[4]int]int
+	count  int
+}
+
+// WriteMacrocell writes a pattern in Golly's macrocell format, with its middle at the origin as Golly
+// expects. The square the quadtree covers is the smallest that holds the pattern with its middle there.
+func WriteMacrocell(w io.Writer, p Pattern) error {
+	level := leafLevel
+	for 1<<(level-1) < p.Width-p.Width/2 || 1<<(level-1) < p.Height-p.Height/2 {
+		level++
+	}
+	// Move the cells so that the middle of the pattern is the middle of the square
+	size := 1 << level
+	cells := make([]util.Cell, len(p.Cells))
+	for i, cell := range p.Cells {
+		cells[i] = util.Cell{X: cell.X - p.Width/2 + size/2, Y: cell.Y - p.Height/2 + size/2}
+	}
+
+	mw := &mcWriter{b: bufio.NewWriter(w), leaves: make(map[[8]uint8]int), nodes: make(map[[4]int]int)}
+	fmt.Fprintln(mw.b, "[M2] (gameoflife)")
+	for _, line := range p.commentLines() {
+		fmt.Fprintln(mw.b, "#C", line)
+	}
+	if p.Rule != "" {
+		fmt.Fprintln(mw.b, "#R", p.Rule)
+	}
+	if mw.node(level, 0, 0, cells) == 0 {
+		// Even an empty pattern needs a node, so write an empty leaf
+		mw.b.WriteString("$\n")
+	}
+	return mw.b.Flush()
+}
+
+// node writes the node of the square at (x, y) with sides of 2^level, after the nodes it is made of,
+// and gives its number, or 0 if none of the cells in it are alive.
+func (mw *mcWriter) node(level, x, y int, cells []util.Cell) int {
+	if len(cells) == 0 {
+		return 0
+	}
+	if level == leafLevel {
+		var rows [8]uint8
+		for _, cell := range cells {
+			rows[cell.Y-y] |= 1 << (cell.X - x)
+		}
+		if n, ok := mw.leaves[rows]; ok {
+			return n
+		}
+		last := 7
+		for last >= 0 && rows[last] == 0 {
+			last--
+		}
+		for _, bits := range rows[:last+1] {
+			for col := 0; bits>>col != 0; col++ {
+				if bits>>col&1 == 1 {
+					mw.b.WriteByte('*')
+				} else {
+					mw.b.WriteByte('.')
+				}
+			}
+			mw.b.WriteByte('$')
+		}
+		mw.b.WriteByte('\n')
+		mw.count++
+		mw.leaves[rows] = mw.count
+		return mw.count
+	}
+
+	half := 1 << (level - 1)
+	var quarters [4][]util.Cell
+	for _, cell := range cells {
+		q := 0
+		if cell.X >= x+half {
+			q++
+		}
+		if cell.Y >= y+half {
+			q += 2
+		}
+		quarters[q] = append(quarters[q], cell)
+	}
+	var children [4]int
+	for q := range children {
+		children[q] = mw.node(level-1, x+q%2*half, y+q/2*half, quarters[q])
+	}
+	if n, ok := mw.nodes[children]; ok {
+		return n
+	}
+	fmt.Fprintln(mw.b, level, children[0], children[1], children[2], children[3])
+	mw.count++
+	mw.nodes[children] = mw.count
+	return mw.count
+}
@@ -0,0 +1,193 @@
+// macrocell_test.go
+package patterns
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// gliderMacrocell is a glider as Golly saves it.
+const gliderMacrocell = `[M2] (golly 4.2)
+#R B3/S23
+.*$..*$***$
+4 1 0 0 0
+`
+
+// sortedCells gives cells in order, moved so that the leftmost is at x = 0 and the topmost at y = 0, for
+// comparing patterns that may have been moved.
+func sortedCells(cells []util.Cell) []util.Cell {
+	minX, minY := 0, 0
+	for i, cell := range cells {
+		if i == 0 || cell.X < minX {
+			minX = cell.X
+		}
+		if i == 0 || cell.Y < minY {
+			minY = cell.Y
+		}
+	}
+	sorted := make([]util.Cell, len(cells))
+	for i, cell := range cells {
+		sorted[i] = util.Cell{X: cell.X - minX, Y: cell.Y - minY}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Y < sorted[j].Y || sorted[i].Y == sorted[j].Y && sorted[i].X < sorted[j].X
+	})
+	return sorted
+}
+
+// TestParseMacrocell tests patterns read from macrocell files, some with nodes used more than once.
+func TestParseMacrocell(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		size  int
+		rule  string
+		cells []util.Cell
+	}{
+		{"glider", gliderMacrocell, 16, "B3/S23", []util.Cell{{X: 1, Y: 0}, {X: 2, Y: 1}, {X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}}},
+		{"shared", "[M2]\n*$\n4 1 1 1 1\n", 16, "", []util.Cell{{X: 0, Y: 0}, {X: 8, Y: 0}, {X: 0, Y: 8}, {X: 8, Y: 8}}},
+		{"full leaf row", "[M2]\n#R 23/3\n********$\n", 8, "23/3", []util.Cell{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 2, Y: 0}, {X: 3, Y: 0}, {X: 4, Y: 0}, {X: 5, Y: 0}, {X: 6, Y: 0}, {X: 7, Y: 0}}},
+		{"last row", "[M2]\r\n$$$$$$$.......*$\r\n", 8, "", []util.Cell{{X: 7, Y: 7}}},
+		{"empty", "[M2]\n$\n", 8, "", nil},
+	}
+	for _, test := range tests {
+		p, err := ParseMacrocell(test.name, test.text, 1000, 1000)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if p.Width != test.size || p.Height != test.size || p.Rule != test.rule {
+			t.Errorf("%v: %dx%d with rule %q, expected %dx%d with %q", test.name, p.Width, p.Height, p.Rule, test.size, test.size, test.rule)
+		}
+		sort.Slice(p.Cells, func(i, j int) bool {
+			return p.Cells[i].Y < p.Cells[j].Y || p.Cells[i].Y == p.Cells[j].Y && p.Cells[i].X < p.Cells[j].X
+		})
+		if len(p.Cells) != 0 || len(test.cells) != 0 {
+			if !reflect.DeepEqual(p.Cells, test.cells) {
+				t.Errorf("%v: cells %v, expected %v", test.name, p.Cells, test.cells)
+			}
+		}
+	}
+}
+
+// deepMacrocell gives a file whose last node is at the given level and is made of copies of the node
+// below it in the given quarters, all the way down to a single alive cell.
+func deepMacrocell(level int, quarters [4]bool) string {
+	var b strings.Builder
+	b.WriteString("[M2]\n*$\n")
+	for l := leafLevel + 1; l <= level; l++ {
+		b.WriteString(fmt.Sprint(l))
+		for _, used := range quarters {
+			if used {
+				fmt.Fprintf(&b, " %d", l-leafLevel)
+			} else {
+				b.WriteString(" 0")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// TestParseMacrocellDeep tests files that describe huge squares in a few lines: they are read if their
+// alive cells fit, and refused before their cells are listed if not.
+func TestParseMacrocellDeep(t *testing.T) {
+	p, err := ParseMacrocell("lonely", deepMacrocell(40, [4]bool{false, false, false, true}), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Width != 1<<40 || len(p.Cells) != 1 || p.Cells[0] != (util.Cell{X: 1<<40 - 1<<leafLevel, Y: 1<<40 - 1<<leafLevel}) {
+		t.Errorf("%v wide with cells %v, expected one cell in the bottom right leaf", p.Width, p.Cells)
+	}
+
+	for _, test := range []struct {
+		quarters      [4]bool
+		width, height int
+	}{
+		{[4]bool{true, true, true, true}, 64, 64},
+		{[4]bool{true, true, false, false}, 64, 1 << 20},
+		{[4]bool{true, false, true, false}, 1 << 20, 64},
+	} {
+		_, err := ParseMacrocell("deep", deepMacrocell(40, test.quarters), test.width, test.height)
+		if err == nil || !strings.Contains(err.Error(), "too big") {
+			t.Errorf("%v: error %v, expected the pattern to be too big", test.quarters, err)
+		}
+	}
+}
+
+// TestParseMacrocellInvalid tests that files that are not macrocells, or are malformed, are refused.
+func TestParseMacrocellInvalid(t *testing.T) {
+	for _, text := range []string{
+		"", "x = 3, y = 3\n", "[M2]\n", "[M2]\n#R B3/S23\n",
+		"[M2]\n*********$\n", "[M2]\n$$$$$$$$*$\n", "[M2]\n*o$\n",
+		"[M2]\n*$\n4 1 0 0\n", "[M2]\n*$\n4 2 0 0 0\n", "[M2]\n*$\n5 1 0 0 0\n", "[M2]\n*$\n3 1 0 0 0\n", "[M2]\n*$\n4 1 x 0 0\n",
+	} {
+		if _, err := ParseMacrocell("invalid", text, 1000, 1000); err == nil {
+			t.Errorf("%q was accepted", text)
+		}
+	}
+}
+
+// TestMacrocellRoundTrip tests that patterns written as macrocells read back with the same cells and rule,
+// with their middles kept in the same place.
+func TestMacrocellRoundTrip(t *testing.T) {
+	world := make([][]byte, 37)
+	for y := range world {
+		world[y] = make([]byte, 101)
+		for x := range world[y] {
+			if (x*x+3*y)%7 == 0 {
+				world[y][x] = 255
+			}
+		}
+	}
+	glider, _ := ParseMacrocell("glider", gliderMacrocell, 16, 16)
+	soup, _ := FromWorld("soup", world)
+	tests := []Pattern{
+		glider,
+		soup,
+		{Name: "dot", Width: 1, Height: 1, Cells: []util.Cell{{X: 0, Y: 0}}, Rule: "B36/S23"},
+		{Name: "corners", Width: 300, Height: 20, Cells: []util.Cell{{X: 0, Y: 0}, {X: 299, Y: 19}}},
+		{Name: "empty", Width: 5, Height: 5},
+	}
+	for _, p := range tests {
+		var b strings.Builder
+		if err := WriteMacrocell(&b, p); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ParseMacrocell(p.Name, b.String(), p.Width, p.Height)
+		if err != nil {
+			t.Errorf("%v: %v\n%v", p.Name, err, b.String())
+			continue
+		}
+		if read.Rule != p.Rule {
+			t.Errorf("%v: rule %q, expected %q", p.Name, read.Rule, p.Rule)
+		}
+		if !reflect.DeepEqual(sortedCells(read.Cells), sortedCells(p.Cells)) {
+			t.Errorf("%v: cells differ after a round trip", p.Name)
+		}
+		// Placed in the middle of a world, as the io goroutine places them, the cells must not move
+		if len(p.Cells) > 0 {
+			dx, dy := p.Width/2-read.Width/2, p.Height/2-read.Height/2
+			for _, cell := range p.Cells {
+				if !contains(read.Cells, util.Cell{X: cell.X - dx, Y: cell.Y - dy}) {
+					t.Errorf("%v: cell %v moved", p.Name, cell)
+					break
+				}
+			}
+		}
+	}
+}
+
+func contains(cells []util.Cell, cell util.Cell) bool {
+	for _, c := range cells {
+		if c == cell {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+// patterns.go
+package patterns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// Pattern is an arrangement of alive cells that can be stamped onto a world.
+type Pattern struct {
+	Name    string
+	Width   int
+	Height  int
+	Cells   []util.Cell // Alive cells, relative to the top left corner of the pattern
+	Rule    string      // Rule the pattern's file says it evolves under, if it names one
+	Comment string      // Note written into the file as comment lines, such as how the world was made; not read back
+}
+
+// Parse reads a pattern drawn in plaintext, one row to a line, with O or * for alive cells and . for
+// dead ones. Lines starting with ! are comments, as in .cells files, where "!Name:" names the pattern.
+func Parse(name, text string) (Pattern, error) {
+	var rows []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		switch {
+		case strings.HasPrefix(line, "!Name:"):
+			if n := strings.TrimSpace(line[len("!Name:"):]); n != "" {
+				name = n
+			}
+		case !strings.HasPrefix(line, "!"):
+			rows = append(rows, line)
+		}
+	}
+	// Blank lines at the end are not rows of the pattern
+	for len(rows) > 0 && rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	}
+
+	p := Pattern{Name: name, Height: len(rows)}
+	for y, row := range rows {
+		for x, c := range row {
+			switch c {
+			case 'O', '*':
+				p.Cells = append(p.Cells, util.Cell{X: x, Y: y})
+			case '.':
+			default:
+				return Pattern{}, fmt.Errorf("pattern %v: unexpected %q in row %v", name, c, y)
+			}
+		}
+		if len(row) > p.Width {
+			p.Width = len(row)
+		}
+	}
+	return p, nil
+}
+
+// Bounds gives the top left corner, width and height of the smallest rectangle holding every alive cell
+// of the pattern, which may be smaller than the pattern's size. A pattern without alive cells gives zeros.
+func (p Pattern) Bounds() (x, y, width, height int) {
+	if len(p.Cells) == 0 {
+		return 0, 0, 0, 0
+	}
+	minX, minY, maxX, maxY := p.Cells[0].X, p.Cells[0].Y, p.Cells[0].X, p.Cells[0].Y
+	for _, cell := range p.Cells {
+		if cell.X < minX {
+			minX = cell.X
+		}
+		if cell.X > maxX {
+			maxX = cell.X
+		}
+		if cell.Y < minY {
+			minY = cell.Y
+		}
+		if cell.Y > maxY {
+			maxY = cell.Y
+		}
+	}
+	return minX, minY, maxX - minX + 1, maxY - minY + 1
+}
+
+// Extent gives the width and height of the smallest rectangle holding every alive cell of the pattern.
+func (p Pattern) Extent() (int, int) {
+	_, _, width, height := p.Bounds()
+	return width, height
+}
+
+// Rotate turns the pattern clockwise by a number of quarter turns.
+func (p Pattern) Rotate(quarterTurns int) Pattern {
+	for i := 0; i < (quarterTurns%4+4)%4; i++ {
+		turned := Pattern{Name: p.Name, Width: p.Height, Height: p.Width, Rule: p.Rule}
+		for _, cell := range p.Cells {
+			turned.Cells = append(turned.Cells, util.Cell{X: p.Height - 1 - cell.Y, Y: cell.X})
+		}
+		p = turned
+	}
+	return p
+}
+
+// Flip mirrors the pattern left to right.
+func (p Pattern) Flip() Pattern {
+	flipped := Pattern{Name: p.Name, Width: p.Width, Height: p.Height, Rule: p.Rule}
+	for _, cell := range p.Cells {
+		flipped.Cells = append(flipped.Cells, util.Cell{X: p.Width - 1 - cell.X, Y: cell.Y})
+	}
+	return flipped
+}
+
+// Stamp brings the cells of a pattern to life with its top left corner at (x, y), wrapping around the
+// edges of the world. Cells the pattern leaves dead are left as they are.
+func Stamp(world [][]byte, p Pattern, x, y int) {
+	height := len(world)
+	if height == 0 {
+		return
+	}
+	width := len(world[0])
+	for _, cell := range p.Cells {
+		cx := ((x+cell.X)%width + width) % width
+		cy := ((y+cell.Y)%height + height) % height
+		world[cy][cx] = 255
+	}
+}
+
+// Placement is a pattern from the library put at a position in a world. The pattern is flipped
+// left to right first if Flip is set, then turned clockwise by Rotate quarter turns.
+type Placement struct {
+	Pattern string // Name of the pattern in the library
+	X, Y    int    // Position of the top left corner of the placed pattern
+	Rotate  int
+	Flip    bool
+}
+
+// ParsePlacement reads a placement written as "name@x,y", optionally followed by "/90", "/180" or
+// "/270" to turn the pattern clockwise and "/flip" to mirror it, such as "glider@10,20/90/flip".
+func ParsePlacement(s string) (Placement, error) {
+	invalid := fmt.Errorf("invalid placement %q: expected name@x,y[/90|/180|/270][/flip]", s)
+	at := strings.Index(s, "@")
+	if at <= 0 {
+		return Placement{}, invalid
+	}
+	pl := Placement{Pattern: s[:at]}
+	parts := strings.Split(s[at+1:], "/")
+	position := strings.Split(parts[0], ",")
+	if len(position) != 2 {
+		return Placement{}, invalid
+	}
+	var err error
+	if pl.X, err = strconv.Atoi(position[0]); err != nil {
+		return Placement{}, invalid
+	}
+	if pl.Y, err = strconv.Atoi(position[1]); err != nil {
+		return Placement{}, invalid
+	}
+	for _, part := range parts[1:] {
+		switch strings.ToLower(part) {
+		case "90":
+			pl.Rotate = 1
+		case "180":
+			pl.Rotate = 2
+		case "270":
+			pl.Rotate = 3
+		case "flip":
+			pl.Flip = true
+		default:
+			return Placement{}, invalid
+		}
+	}
+	if _, err = Lookup(pl.Pattern); err != nil {
+		return Placement{}, err
+	}
+	return pl, nil
+}
+
+// ParsePlacements reads a list of placements separated by spaces.
+func ParsePlacements(s string) ([]Placement, error) {
+	var placements []Placement
+	for _, field := range strings.Fields(s) {
+		pl, err := ParsePlacement(field)
+		if err != nil {
+			return nil, err
+		}
+		placements = append(placements, pl)
+	}
+	return placements, nil
+}
+
+// String gives the placement in the form ParsePlacement reads.
+func (pl Placement) String() string {
+	s := fmt.Sprintf("%v@%d,%d", pl.Pattern, pl.X, pl.Y)
+	if turn := (pl.Rotate%4 + 4) % 4; turn != 0 {
+		s += fmt.Sprintf("/%d", 90*turn)
+	}
+	if pl.Flip {
+		s += "/flip"
+	}
+	return s
+}
+
+// Resolve looks up the placed pattern and turns it as the placement says.
+func (pl Placement) Resolve() (Pattern, error) {
+	p, err := Lookup(pl.Pattern)
+	if err != nil {
+		return Pattern{}, err
+	}
+	if pl.Flip {
+		p = p.Flip()
+	}
+	return p.Rotate(pl.Rotate), nil
+}
+
+// Place stamps each placement onto a world in turn.
+func Place(world [][]byte, placements ...Placement) error {
+	for _, pl := range placements {
+		p, err := pl.Resolve()
+		if err != nil {
+			return err
+		}
+		Stamp(world, p, pl.X, pl.Y)
+	}
+	return nil
+}
+
+// Compose makes a world of dead cells and stamps the placements onto it.
+func Compose(height, width int, placements ...Placement) ([][]byte, error) {
+	world := make([][]byte, height)
+	for y := range world {
+		world[y] = make([]byte, width)
+	}
+	return world, Place(world, placements...)
+}
@@ -0,0 +1,248 @@
+// rle.go
+package patterns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// maxLine is the longest line patterns are written with, as pattern collections expect.
+const maxLine = 70
+
+// ParseRLE reads a pattern in the run length encoded format used by Golly and most pattern collections.
+// Lines starting with # come first, #N naming the pattern, then a header such as
+// "x = 3, y = 3, rule = B3/S23" giving its size and rule, then the cells row by row as runs of b (dead)
+// or o (alive), each optionally preceded by its length, with $ ending a row and ! ending the pattern.
+// Any bounded grid Golly adds to the rule, as in "B3/S23:T64,64", is dropped.
+func ParseRLE(name, text string) (Pattern, error) {
+	p := Pattern{Name: name}
+	lines := strings.Split(strings.ReplaceAll(text, "\r", ""), "\n")
+	header := -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#N") {
+			if n := strings.TrimSpace(line[2:]); n != "" {
+				p.Name = n
+			}
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			header = i
+			break
+		}
+	}
+	if header < 0 {
+		return Pattern{}, fmt.Errorf("pattern %v: no header line", name)
+	}
+
+	key := ""
+	for _, field := range strings.Split(lines[header], ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 1 && key == "rule" {
+			// Larger than Life rules are themselves separated by commas
+			p.Rule += "," + strings.TrimSpace(field)
+			continue
+		}
+		if len(kv) != 2 {
+			return Pattern{}, fmt.Errorf("pattern %v: invalid header %q", name, lines[header])
+		}
+		var value string
+		key, value = strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "x":
+			p.Width, err = strconv.Atoi(value)
+		case "y":
+			p.Height, err = strconv.Atoi(value)
+		case "rule":
+			p.Rule = value
+		}
+		if err != nil || p.Width < 0 || p.Height < 0 {
+			return Pattern{}, fmt.Errorf("pattern %v: invalid %v in header %q", name, key, lines[header])
+		}
+	}
+
+	p.Rule = strings.SplitN(p.Rule, ":", 2)[0]
+
+	x, y, run := 0, 0, 0
+	data := strings.Join(lines[header+1:], "\n")
+cells:
+	for i, c := range data {
+		switch {
+		case c >= '0' && c <= '9':
+			run = run*10 + int(c-'0')
+			continue
+		case c == ' ' || c == '\t' || c == '\n':
+			continue
+		}
+		count := run
+		if count == 0 {
+			count = 1
+		}
+		run = 0
+		switch c {
+		case 'b', '.':
+			x += count
+		case 'o', 'A':
+			for j := 0; j < count; j++ {
+				p.Cells = append(p.Cells, util.Cell{X: x, Y: y})
+				x++
+			}
+		case '$':
+			x, y = 0, y+count
+		case '!':
+			break cells
+		default:
+			return Pattern{}, fmt.Errorf("pattern %v: unexpected %q at offset %v, as only two-state patterns can be read", name, c, i)
+		}
+		// Some files leave their cells spilling out of the size in the header
+		if x > p.Width {
+			p.Width = x
+		}
+		if y >= p.Height && x > 0 {
+			p.Height = y + 1
+		}
+	}
+	return p, nil
+}
+
+// WriteRLE writes a pattern in the run length encoded format ParseRLE reads.
+func WriteRLE(w io.Writer, p Pattern) error {
+	grid, err := p.grid()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	if p.Name != "" {
+		fmt.Fprintln(b, "#N", p.Name)
+	}
+	for _, line := range p.commentLines() {
+		fmt.Fprintln(b, "#C", line)
+	}
+	fmt.Fprintf(b, "x = %d, y = %d", p.Width, p.Height)
+	if p.Rule != "" {
+		fmt.Fprintf(b, ", rule = %v", p.Rule)
+	}
+	fmt.Fprintln(b)
+
+	// Runs are written as they end, which leaves out the dead cells at the end of each row
+	// and folds the empty rows before the next alive cell into a single run of $
+	line := 0
+	emit := func(count int, tag byte) {
+		token := string(tag)
+		if count > 1 {
+			token = strconv.Itoa(count) + token
+		}
+		if line+len(token) > maxLine {
+			b.WriteByte('\n')
+			line = 0
+		}
+		b.WriteString(token)
+		line += len(token)
+	}
+	rowsEnded := 0
+	for y, row := range grid {
+		dead := 0
+		for x := 0; x < len(row); {
+			end := x
+			for end < len(row) && row[end] == row[x] {
+				end++
+			}
+			if !row[x] {
+				dead = end - x
+			} else {
+				if rowsEnded > 0 {
+					emit(rowsEnded, '$')
+					rowsEnded = 0
+				}
+				if dead > 0 {
+					emit(dead, 'b')
+				}
+				emit(end-x, 'o')
+			}
+			x = end
+		}
+		if y < len(grid)-1 {
+			rowsEnded++
+		}
+	}
+	emit(1, '!')
+	b.WriteByte('\n')
+	return b.Flush()
+}
+
+// WriteCells writes a pattern in plaintext, as Parse reads it, with its name in a !Name: comment.
+// Every row is written out in full, so that the pattern reads back at the same size.
+func WriteCells(w io.Writer, p Pattern) error {
+	grid, err := p.grid()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	if p.Name != "" {
+		fmt.Fprintln(b, "!Name:", p.Name)
+	}
+	for _, line := range p.commentLines() {
+		fmt.Fprintln(b, "!"+line)
+	}
+	for _, row := range grid {
+		for _, alive := range row {
+			if alive {
+				b.WriteByte('O')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.Flush()
+}
+
+// commentLines splits the pattern's comment into the lines to write it as.
+func (p Pattern) commentLines() []string {
+	if p.Comment == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(p.Comment, "\r", ""), "\n")
+}
+
+// grid lays the cells of the pattern out row by row, or explains which cell lies outside the pattern's size.
+func (p Pattern) grid() ([][]bool, error) {
+	grid := make([][]bool, p.Height)
+	for y := range grid {
+		grid[y] = make([]bool, p.Width)
+	}
+	for _, cell := range p.Cells {
+		if cell.X < 0 || cell.X >= p.Width || cell.Y < 0 || cell.Y >= p.Height {
+			return nil, fmt.Errorf("pattern %v: cell (%v, %v) lies outside its %dx%d size", p.Name, cell.X, cell.Y, p.Width, p.Height)
+		}
+		grid[cell.Y][cell.X] = true
+	}
+	return grid, nil
+}
+
+// FromWorld makes a pattern of the alive cells of a world, the same size as the world. Pattern files
+// only hold alive cells, so a world with cells in the dying states of a Generations rule is refused
+// rather than saved without them.
+func FromWorld(name string, world [][]byte) (Pattern, error) {
+	p := Pattern{Name: name, Height: len(world)}
+	for y, row := range world {
+		if len(row) > p.Width {
+			p.Width = len(row)
+		}
+		for x, cell := range row {
+			switch cell {
+			case 255:
+				p.Cells = append(p.Cells, util.Cell{X: x, Y: y})
+			case 0:
+			default:
+				return Pattern{}, fmt.Errorf("pattern %v: cell (%v, %v) is dying, which pattern files cannot hold", name, x, y)
+			}
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,230 @@
+// rle_test.go
+package patterns
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// gosperGunRLE is Gosper's glider gun as pattern collections give it.
+const gosperGunRLE = `#N Gosper glider gun
+#O Bill Gosper
+#C A true period 30 glider gun.
+x = 36, y = 9, rule = B3/S23
+24bo$22bobo$12b2o6b2o12b2o$11bo3bo4b2o12b2o$2o8bo5bo3b2o$2o8bo3bob2o4b
+obo$10bo5bo7bo$11bo3bo$12b2o!
+`
+
+// gosperGunCells is the same gun drawn out in plaintext.
+const gosperGunCells = `!Name: Gosper glider gun
+........................O...........
+......................O.O...........
+............OO......OO............OO
+...........O...O....OO............OO
+OO........O.....O...OO..............
+OO........O...O.OO....O.O...........
+..........O.....O.......O...........
+...........O...O....................
+............OO......................
+`
+
+// TestParseRLE tests patterns as pattern collections and Golly write them.
+func TestParseRLE(t *testing.T) {
+	gun, err := Parse("gun", gosperGunCells)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gun.Rule = "B3/S23"
+
+	tests := []struct {
+		name string
+		text string
+		want Pattern
+	}{
+		{"gun", gosperGunRLE, gun},
+		{"bounded grid", "x = 3, y = 1, rule = B36/S23:T64,64\n3o!\n",
+			Pattern{Width: 3, Height: 1, Cells: []util.Cell{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 2, Y: 0}}, Rule: "B36/S23"}},
+		{"larger than life", "#C a comment\nx = 2, y = 1, rule = R2,C0,M1,S2..3,B3..3,NM\n2o!\n",
+			Pattern{Width: 2, Height: 1, Cells: []util.Cell{{X: 0, Y: 0}, {X: 1, Y: 0}}, Rule: "R2,C0,M1,S2..3,B3..3,NM"}},
+		{"no rule", "x=2,y=2\r\nbo$\r\nA.!\r\n",
+			Pattern{Width: 2, Height: 2, Cells: []util.Cell{{X: 1, Y: 0}, {X: 0, Y: 1}}}},
+		{"runs across lines", "x = 12, y = 3\n1\n1bo\n2\n$o!",
+			Pattern{Width: 12, Height: 3, Cells: []util.Cell{{X: 11, Y: 0}, {X: 0, Y: 2}}}},
+		{"cells after the end", "x = 1, y = 1\no!2o\n", Pattern{Width: 1, Height: 1, Cells: []util.Cell{{X: 0, Y: 0}}}},
+		// Cells spilling out of the size in the header make the pattern bigger
+		{"spilling", "x = 2, y = 1\n5o2$3o!",
+			Pattern{Width: 5, Height: 3, Cells: []util.Cell{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 2, Y: 0}, {X: 3, Y: 0}, {X: 4, Y: 0}, {X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}}}},
+		{"empty", "x = 4, y = 3\n!", Pattern{Width: 4, Height: 3}},
+	}
+	for _, test := range tests {
+		p, err := ParseRLE(test.name, test.text)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if test.want.Name == "" {
+			test.want.Name = test.name
+		}
+		if !reflect.DeepEqual(p, test.want) {
+			t.Errorf("%v: read as %+v, expected %+v", test.name, p, test.want)
+		}
+	}
+}
+
+// TestParseRLEInvalid tests that files without a valid header, or with cells in more than two states,
+// are refused.
+func TestParseRLEInvalid(t *testing.T) {
+	for _, text := range []string{
+		"", "#N nothing else\n", "3o!", "x = a, y = 1\n!", "x = 1, y = -1\n!", "x = 3, y = 3\n3B!", "x = 3, y = 3\nobq!",
+	} {
+		if _, err := ParseRLE("invalid", text); err == nil {
+			t.Errorf("%q was accepted", text)
+		}
+	}
+}
+
+// roundTripPatterns gives patterns with rows too long for a line, empty rows at the top and bottom, and
+// no cells at all.
+func roundTripPatterns(t *testing.T) []Pattern {
+	gun, err := ParseRLE("gun", gosperGunRLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	world := make([][]byte, 37)
+	for y := range world {
+		world[y] = make([]byte, 101)
+		for x := range world[y] {
+			if (x*x+3*y)%7 == 0 && y%9 != 0 {
+				world[y][x] = 255
+			}
+		}
+	}
+	soup, err := FromWorld("soup", world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soup.Rule = "B36/S23"
+	line := Pattern{Name: "line", Width: 300, Height: 3}
+	for x := 0; x < 300; x++ {
+		if x%50 != 49 {
+			line.Cells = append(line.Cells, util.Cell{X: x, Y: 1})
+		}
+	}
+	return []Pattern{gun, soup, line, {Name: "empty", Width: 4, Height: 3}}
+}
+
+// checkLines checks that no line of a written pattern runs past maxLine characters.
+func checkLines(t *testing.T, name, text string) {
+	t.Helper()
+	for i, line := range strings.Split(text, "\n") {
+		if len(line) > maxLine && !strings.HasPrefix(line, "#N") {
+			t.Errorf("%v: line %v is %v characters long", name, i+1, len(line))
+		}
+	}
+}
+
+// TestRLERoundTrip tests that patterns written as RLE read back the same.
+func TestRLERoundTrip(t *testing.T) {
+	for _, p := range roundTripPatterns(t) {
+		var b strings.Builder
+		if err := WriteRLE(&b, p); err != nil {
+			t.Fatal(err)
+		}
+		checkLines(t, p.Name, b.String())
+		read, err := ParseRLE("read", b.String())
+		if err != nil {
+			t.Errorf("%v: %v\n%v", p.Name, err, b.String())
+			continue
+		}
+		if !reflect.DeepEqual(read, p) {
+			t.Errorf("%v: read back as %+v\n%v", p.Name, read, b.String())
+		}
+	}
+}
+
+// TestCellsRoundTrip tests that patterns written in plaintext read back the same, but for their rules,
+// which plaintext has no place for.
+func TestCellsRoundTrip(t *testing.T) {
+	for _, p := range roundTripPatterns(t) {
+		var b strings.Builder
+		if err := WriteCells(&b, p); err != nil {
+			t.Fatal(err)
+		}
+		read, err := Parse("read", b.String())
+		if err != nil {
+			t.Errorf("%v: %v\n%v", p.Name, err, b.String())
+			continue
+		}
+		p.Rule = ""
+		if !reflect.DeepEqual(read, p) {
+			t.Errorf("%v: read back as %+v\n%v", p.Name, read, b.String())
+		}
+	}
+}
+
+// TestWriteComment tests that a pattern's comment is written as comment lines, which are passed over
+// when the pattern is read back.
+func TestWriteComment(t *testing.T) {
+	p := Pattern{Name: "noted", Width: 3, Height: 2, Cells: []util.Cell{{X: 1, Y: 0}, {X: 2, Y: 1}},
+		Comment: "generate=random density=0.3 seed=42\nsecond line"}
+	tests := []struct {
+		name  string
+		write func(io.Writer, Pattern) error
+		parse func(string, string) (Pattern, error)
+		lines []string
+	}{
+		{"RLE", WriteRLE, ParseRLE, []string{"#C generate=random density=0.3 seed=42", "#C second line"}},
+		{"plaintext", WriteCells, Parse, []string{"!generate=random density=0.3 seed=42", "!second line"}},
+		{"macrocell", WriteMacrocell, func(name, text string) (Pattern, error) { return ParseMacrocell(name, text, 3, 2) },
+			[]string{"[M2] (gameoflife)\n#C generate=random density=0.3 seed=42", "#C second line"}},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		if err := test.write(&b, p); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range test.lines {
+			if !strings.Contains("\n"+b.String(), "\n"+line+"\n") {
+				t.Errorf("%v: no line %q in\n%v", test.name, line, b.String())
+			}
+		}
+		read, err := test.parse("read", b.String())
+		if err != nil {
+			t.Errorf("%v: %v\n%v", test.name, err, b.String())
+			continue
+		}
+		if len(read.Cells) != len(p.Cells) || read.Comment != "" {
+			t.Errorf("%v: read back as %+v\n%v", test.name, read, b.String())
+		}
+	}
+}
+
+// TestFromWorldDying tests that worlds with cells in dying states, which pattern files cannot hold,
+// are refused.
+func TestFromWorldDying(t *testing.T) {
+	world := [][]byte{{0, 255, 0}, {0, 255, 127}}
+	if p, err := FromWorld("dying", world); err == nil {
+		t.Errorf("made into %+v", p)
+	}
+	world[1][2] = 0
+	if p, err := FromWorld("alive", world); err != nil || len(p.Cells) != 2 {
+		t.Errorf("made into %+v, error %v", p, err)
+	}
+}
+
+// TestWriteOutside tests that patterns with cells outside their size are refused rather than written.
+func TestWriteOutside(t *testing.T) {
+	for _, cell := range []util.Cell{{X: 2, Y: 0}, {X: 0, Y: 3}, {X: -1, Y: 0}} {
+		p := Pattern{Name: "outside", Width: 2, Height: 3, Cells: []util.Cell{{X: 0, Y: 0}, cell}}
+		for name, write := range map[string]func(io.Writer, Pattern) error{"RLE": WriteRLE, "plaintext": WriteCells} {
+			var b strings.Builder
+			if err := write(&b, p); err == nil || b.Len() > 0 {
+				t.Errorf("%v: cell %v written as %q, error %v", name, cell, b.String(), err)
+			}
+		}
+	}
+}
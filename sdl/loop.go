@@ -57,6 +57,10 @@ sdl:
 				for _, cell := range e.Cells {
 					w.FlipPixel(cell.X, cell.Y) 
 				}
+			case gol.CellsChanged:
+				for i, cell := range e.Cells {
+					w.SetGrey(cell.X, cell.Y, e.Greys[i])
+				}
 			case gol.TurnComplete:
 				dirty = true
 			case gol.AliveCellsCount:
@@ -88,6 +88,19 @@ func (w *Window) FlipPixel(x, y int) {
 	w.pixels[4*(y*width+x)+3] = ^w.pixels[4*(y*width+x)+3]
 }
 
+// SetGrey sets a pixel to a grey level, as used for the cell states of multi-state rules.
+func (w *Window) SetGrey(x, y int, grey uint8) {
+	if x < 0 || y < 0 || x >= int(w.Width) || y >= int(w.Height) {
+		panic(fmt.Sprintf("CellsChanged event at (%d, %d) is outside the bounds of the window.", x, y))
+	}
+
+	width := int(w.Width)
+	w.pixels[4*(y*width+x)+0] = grey
+	w.pixels[4*(y*width+x)+1] = grey
+	w.pixels[4*(y*width+x)+2] = grey
+	w.pixels[4*(y*width+x)+3] = grey
+}
+
 func (w *Window) CountPixels() int {
 	count := 0
 	for i := 0; i < int(w.Width) * int(w.Height) * 4; i += 4 {
@@ -0,0 +1,189 @@
+// cluster.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/engine"
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// worker is a registered worker process
+type worker struct {
+	address string
+	client  *rpc.Client
+
+	clusters int       // Number of sessions' clusters the worker is part of
+	leaving  chan bool // Closed once a deregistered worker no longer holds any strips
+}
+
+var (
+	callTimeout      = 30 * time.Second // Time to wait for a worker before treating it as failed
+	heartbeatTimeout = 2 * time.Second  // Time to wait for a worker to answer a heartbeat
+)
+
+// cluster is a set of workers that each hold one horizontal strip of the world
+// and swap halo rows directly with the workers either side of them
+type cluster struct {
+	workers    []*worker
+	session    int // Session whose world the strips belong to
+	generation int // Assignment of strips within the session
+	height     int
+	width      int
+	rule       engine.Rule
+	topology   engine.Topology
+	sides      [][]byte // Side columns of every row of the world, on topologies that need them
+	sparse     bool     // Whether the workers evolve their strips with the sparse engine
+}
+
+// startCluster splits the world into strips and hands one to each worker, telling each
+// worker which workers hold the strips above and below it, and whether to use the sparse engine
+func startCluster(workers []*worker, session, generation int, world [][]byte, height, width int, rule engine.Rule, topology engine.Topology, sparse bool) (*cluster, error) {
+	c := &cluster{workers: workers, session: session, generation: generation, height: height, width: width, rule: rule, topology: topology, sparse: sparse}
+	if topology.NeedsSides() {
+		c.sides = engine.SideColumns(world, rule.Radius)
+	}
+	err := c.callAll(func(i int, w *worker) *rpc.Call {
+		startY := i * height / len(workers)
+		endY := (i + 1) * height / len(workers)
+		request := stubs.InitRequest{
+			Session:     session,
+			Strip:       world[startY:endY],
+			StartY:      startY,
+			ImageHeight: height,
+			ImageWidth:  width,
+			Rule:        rule.String(),
+			Topology:    topology.String(),
+			Above:       workers[(i-1+len(workers))%len(workers)].address,
+			Below:       workers[(i+1)%len(workers)].address,
+			Generation:  generation,
+			Sparse:      sparse,
+		}
+		return w.client.Go(stubs.WorkerInitHandler, request, new(stubs.InitResponse), nil)
+	})
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// release tells every worker to forget its strip, without waiting for them to answer
+func (c *cluster) release() {
+	request := stubs.ReleaseRequest{Session: c.session, Generation: c.generation}
+	for _, w := range c.workers {
+		w.client.Go(stubs.ReleaseHandler, request, new(stubs.ReleaseResponse), nil)
+	}
+}
+
+// callAll starts a call on every worker and waits for all of them to finish,
+// giving up on any that take longer than callTimeout
+func (c *cluster) callAll(call func(i int, w *worker) *rpc.Call) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	calls := make([]*rpc.Call, len(c.workers))
+	for i, w := range c.workers {
+		calls[i] = call(i, w)
+	}
+	var err error
+	for i, call := range calls {
+		select {
+		case <-call.Done:
+			if call.Error != nil && err == nil {
+				err = fmt.Errorf("worker %v: %w", c.workers[i].address, call.Error)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("worker %v timed out", c.workers[i].address)
+		}
+	}
+	return err
+}
+
+// deadWorkers sends a heartbeat to every worker and returns those that do not answer in time
+func deadWorkers(workers []*worker) []*worker {
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
+	defer cancel()
+	calls := make([]*rpc.Call, len(workers))
+	for i, w := range workers {
+		calls[i] = w.client.Go(stubs.PingHandler, stubs.PingRequest{}, new(stubs.PingResponse), nil)
+	}
+	var dead []*worker
+	for i, call := range calls {
+		select {
+		case <-call.Done:
+			if call.Error != nil {
+				dead = append(dead, workers[i])
+			}
+		case <-ctx.Done():
+			dead = append(dead, workers[i])
+		}
+	}
+	return dead
+}
+
+// turn advances every strip by one turn and returns the number of alive cells in the world,
+// along with the cells that changed and their new grey levels if flips is set
+func (c *cluster) turn(turn int, flips bool) (int, stubs.Frame, error) {
+	responses := make([]*stubs.TurnResponse, len(c.workers))
+	err := c.callAll(func(i int, w *worker) *rpc.Call {
+		responses[i] = new(stubs.TurnResponse)
+		request := stubs.TurnRequest{Session: c.session, Turn: turn, Flips: flips}
+		if c.sides != nil {
+			startY, endY := i*c.height/len(c.workers), (i+1)*c.height/len(c.workers)
+			request.Sides, request.SidesFrom = c.stripSides(startY, endY)
+		}
+		return w.client.Go(stubs.WorkerTurnHandler, request, responses[i], nil)
+	})
+	if err != nil {
+		return 0, stubs.Frame{}, err
+	}
+	alive := 0
+	frame := stubs.Frame{Turn: turn}
+	var sides [][]byte
+	for i, res := range responses {
+		alive += res.AliveCellsCount
+		sides = append(sides, res.Sides...)
+		startY := i * c.height / len(c.workers)
+		for _, cell := range res.Flipped {
+			frame.Cells = append(frame.Cells, util.Cell{X: cell.X, Y: cell.Y + startY})
+		}
+		frame.Greys = append(frame.Greys, res.Greys...)
+	}
+	if c.topology.NeedsSides() {
+		c.sides = sides
+	}
+	return alive, frame, nil
+}
+
+// stripSides gives the side columns a strip from startY to endY needs, rather than those of the whole world,
+// along with the row the first of them belongs to.
+func (c *cluster) stripSides(startY, endY int) ([][]byte, int) {
+	from, n := engine.SidesNeeded(startY, endY, c.height, c.rule.Radius)
+	if from+n <= c.height {
+		return c.sides[from : from+n], from
+	}
+	// The rows run on past the bottom edge to the top
+	sides := append([][]byte(nil), c.sides[from:]...)
+	return append(sides, c.sides[:from+n-c.height]...), from
+}
+
+// collect gathers the strips from every worker and stitches them back into a world
+func (c *cluster) collect() ([][]byte, error) {
+	responses := make([]*stubs.CollectResponse, len(c.workers))
+	err := c.callAll(func(i int, w *worker) *rpc.Call {
+		responses[i] = new(stubs.CollectResponse)
+		return w.client.Go(stubs.WorkerCollectHandler, stubs.CollectRequest{Session: c.session}, responses[i], nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var world [][]byte
+	for _, res := range responses {
+		world = append(world, res.Strip...)
+	}
+	return world, nil
+}
@@ -2,209 +2,489 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"math/rand"
 	"net"
 	"net/rpc"
+	"os"
 	"sync"
 	"time"
+	"uk.ac.bris.cs/gameoflife/checkpoint"
+	"uk.ac.bris.cs/gameoflife/engine"
 	"uk.ac.bris.cs/gameoflife/stubs"
-	"uk.ac.bris.cs/gameoflife/util"
 )
 
 var (
-	GolWorld [][]byte
-	GolTurn  int
-	Pause    string = "Continue"
-	Quit     string = "No"
-	Close    string = "No"
-	mu       sync.Mutex
-	KillChan = make(chan bool)
+	KillChan = make(chan bool, 1)
+
+	snapshotInterval int // Turns between copies of each session's world kept in case a worker fails
+
+	checkpointDir      string        // Directory session checkpoints are written to, or empty to disable them
+	checkpointInterval time.Duration // Time between checkpoints of a running session
+
+	engineMode string // Engine sessions are evolved with: "strips", "sparse" or "hashlife"
 )
 
-// Initializes a new empty world of the specified height and width.
-func makeWorld(height int, width int) [][]byte {
-	world := make([][]byte, height)
-	for i := range world {
-		world[i] = make([]byte, width)
+// GameOfLifeOperations struct that serves the RPC methods
+type GameOfLifeOperations struct {
+	Mu      sync.Mutex
+	Workers []*worker
+	version int // Bumped whenever workers join or leave the pool
+
+	sessions map[int]*session
+	started  int // Highest session ID handed out
+	latest   int // Most recently started session
+}
+
+// session looks up a session by ID, where 0 means the most recently started one.
+func (s *GameOfLifeOperations) session(id int) (*session, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if id == 0 {
+		if s.latest == 0 {
+			return nil, errors.New("no simulation has been started on this server")
+		}
+		id = s.latest
 	}
-	return world
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %v is not running on this server", id)
+	}
+	return sess, nil
 }
 
-// GameOfLifeOperations struct that serves the RPC methods
-type GameOfLifeOperations struct {
-	isPaused bool
-	Mu       sync.Mutex
-	World    [][]byte
-	Turns    int
-	Quit     bool
-	Paused   bool
-	Workers  []*rpc.Client
+// Start begins evolving the world in the background and returns a session handle for Wait.
+func (s *GameOfLifeOperations) Start(req stubs.Request, res *stubs.StartResponse) (err error) {
+	sess, err := s.start(req)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Started session", sess.id, "with rule", sess.rule, "on a", sess.topology)
+	if sess.life != nil {
+		fmt.Println("Session", sess.id, "is evolved with HashLife")
+	}
+	res.Session = sess.id
+	return
 }
 
-// GOL processes the Game of Life evolution for the specified number of turns.
-func (s *GameOfLifeOperations) GOL(req stubs.Request, res *stubs.Response) (err error) {
+// start creates a session for the request and runs it in the background.
+func (s *GameOfLifeOperations) start(req stubs.Request) (*session, error) {
+	if req.Turn < 0 {
+		return nil, fmt.Errorf("invalid starting turn %v", req.Turn)
+	}
+	if req.ImageHeight <= 0 || req.ImageWidth <= 0 {
+		return nil, fmt.Errorf("invalid world size %dx%d", req.ImageWidth, req.ImageHeight)
+	}
+	if len(req.InitialWorld) != req.ImageHeight {
+		return nil, fmt.Errorf("world has %v rows, expected %v", len(req.InitialWorld), req.ImageHeight)
+	}
+	for y, row := range req.InitialWorld {
+		if len(row) != req.ImageWidth {
+			return nil, fmt.Errorf("world row %v has %v cells, expected %v", y, len(row), req.ImageWidth)
+		}
+	}
+	rule, err := engine.ParseRule(req.Rule)
+	if err != nil {
+		return nil, err
+	}
+	topology, err := engine.ParseTopology(req.Topology)
+	if err != nil {
+		return nil, err
+	}
 
-	// Initialize the global world and turn state
-	GolWorld = req.InitialWorld
-	height := req.ImageHeight
-	width := req.ImageWidth
-	turns := req.Turns
-
-	// Process each turn, evolving the world state
-	for t := 0; t < turns; t++ {
-		// Check for quit signal
-		if Quit == "Yes" {
-			fmt.Println("Received quit signal. Ending simulation.")
-			break
+	s.Mu.Lock()
+	s.started++
+	// Session IDs start again from 1 whenever the server does, so skip those an earlier run left
+	// checkpoints for rather than writing over them
+	for checkpointDir != "" && fileExists(checkpointPath(s.started)) {
+		s.started++
+	}
+	sess := &session{
+		id:        s.started,
+		ops:       s,
+		turn:      req.Turn,
+		alive:     engine.CountAliveCells(req.InitialWorld),
+		height:    req.ImageHeight,
+		width:     req.ImageWidth,
+		turns:     req.Turns,
+		rule:      rule,
+		topology:  topology,
+		generator: req.Generator,
+		done:      make(chan struct{}),
+		collected: make(chan struct{}),
+
+		// Assume a controller is about to watch a new session, so that it sees every turn
+		watched: time.Now(),
+		tick:    make(chan struct{}),
+	}
+	s.Mu.Unlock()
+
+	if engineMode == "hashlife" {
+		life, lifeErr := engine.NewHashLife(req.InitialWorld, req.ImageHeight, req.ImageWidth, rule, topology)
+		if lifeErr != nil {
+			fmt.Println("Session", sess.id, "cannot use HashLife, so is evolved in strips:", lifeErr)
 		}
+		sess.life = life
+	}
 
-		mu.Lock()
-		GolWorld = executeTurn(GolWorld, height, width)
-		GolTurn = t + 1 // Update the global turn count
-		mu.Unlock()
+	// Hand the world out to the workers, if there are any
+	if sess.life == nil {
+		sess.mu.Lock()
+		err = sess.distribute(req.InitialWorld)
+		sess.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.Mu.Lock()
+	s.sessions[sess.id] = sess
+	s.latest = sess.id
+	s.Mu.Unlock()
+	go sess.run()
+	go s.retire(sess)
+	return sess, nil
+}
 
-		// Check for pause condition
-		for Pause == "Pause" {
-			time.Sleep(1 * time.Second)
+// retire removes a session from the server once it has finished and Wait has collected its result, or
+// once it has been finished for keepFinished without anybody collecting it, so that finished sessions
+// do not hold on to their worlds.
+func (s *GameOfLifeOperations) retire(sess *session) {
+	<-sess.done
+	select {
+	case <-sess.collected:
+		// Let the controller that collected the result fetch the last turns it has not yet shown
+		for {
+			sess.mu.Lock()
+			idle := time.Since(sess.watched)
+			sess.mu.Unlock()
+			if idle >= watchTimeout {
+				break
+			}
+			time.Sleep(watchTimeout - idle)
 		}
+	case <-time.After(keepFinished):
 	}
+	s.Mu.Lock()
+	delete(s.sessions, sess.id)
+	s.Mu.Unlock()
+	fmt.Println("Session", sess.id, "removed")
+}
 
-	// Populate the response with the final world state and alive cells after final state
-	res.FinalWorld = GolWorld
-	res.CompletedTurns = GolTurn
-	res.AliveCellsAfterFinalState = findAliveCells(GolWorld)
+// restore starts a session from a checkpoint file, so that it carries on from where it was saved.
+func (s *GameOfLifeOperations) restore(path string) (*session, error) {
+	c, err := checkpoint.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := s.start(stubs.Request{
+		InitialWorld: c.World,
+		ImageHeight:  c.ImageHeight,
+		ImageWidth:   c.ImageWidth,
+		Turns:        c.Turns,
+		Turn:         c.Turn,
+		Rule:         c.Rule,
+		Topology:     c.Topology,
+		Generator:    c.Generator,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Restored session", sess.id, "from", path, "at turn", c.Turn)
+	return sess, nil
+}
 
+// Wait blocks until the simulation identified by the session handle has finished its last turn
+// and returns its final state.
+func (s *GameOfLifeOperations) Wait(req stubs.WaitRequest, res *stubs.Response) (err error) {
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
+
+	<-sess.done
+	sess.collect.Do(func() { close(sess.collected) })
+	*res = sess.result
+	return sess.err
+}
+
+// Attach lets a newly started controller join a simulation, returning its session handle and the
+// world as of the current turn. The simulation may already have finished, in which case Wait
+// returns straight away.
+func (s *GameOfLifeOperations) Attach(req stubs.AttachRequest, res *stubs.AttachResponse) (err error) {
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	res.Session = sess.id
+	res.ImageHeight = sess.height
+	res.ImageWidth = sess.width
+	res.Turns = sess.turns
+	res.Rule = sess.rule.String()
+	res.Topology = sess.topology.String()
+	res.Turn = sess.turn
+	if !req.NoWorld {
+		res.World, err = sess.currentWorld()
+	}
 	return
 }
 
-// Alive provides the count of currently alive cells and the current turn
+// Changes waits for a session to complete turns after the one the controller last saw, and returns
+// the cells flipped in each of them so that the controller can display them.
+func (s *GameOfLifeOperations) Changes(req stubs.ChangesRequest, res *stubs.ChangesResponse) (err error) {
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
+	return sess.changes(req.Since, res)
+}
+
+// GOL processes the Game of Life evolution for the specified number of turns, returning once it has finished.
+func (s *GameOfLifeOperations) GOL(req stubs.Request, res *stubs.Response) (err error) {
+	started := new(stubs.StartResponse)
+	err = s.Start(req, started)
+	if err != nil {
+		return err
+	}
+	return s.Wait(stubs.WaitRequest{Session: started.Session}, res)
+}
+
+// Alive provides the count of currently alive cells and the current turn of a session
 func (s *GameOfLifeOperations) Alive(req stubs.AliveRequest, res *stubs.AliveResponse) (err error) {
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
 
 	// Wait if the game is paused
-	for Pause == "Pause" {
+	for sess.isPaused() {
 		time.Sleep(1 * time.Second)
 	}
 
 	// Calculate the alive cells based on the current world state
-	mu.Lock()
-	res.Turn = GolTurn
-	res.AliveCellsCount = countAliveCells(GolWorld)
-	mu.Unlock()
+	sess.mu.Lock()
+	res.Turn = sess.turn
+	res.AliveCellsCount = sess.alive
+	sess.mu.Unlock()
 	return
 }
 
+// KillServer stops a session and, unless other sessions are still running, shuts the server down
+// once the reply has been sent
 func (s *GameOfLifeOperations) KillServer(req stubs.KillRequest, res *stubs.KillResponse) (err error) {
-	KillChan <- true
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	sess.quit = true
+	sess.mu.Unlock()
+
+	s.Mu.Lock()
+	others := 0
+	for _, other := range s.sessions {
+		if other != sess && other.running() {
+			others++
+		}
+	}
+	s.Mu.Unlock()
+	if others > 0 {
+		fmt.Println("Session", sess.id, "killed;", others, "other sessions still running")
+		return
+	}
+	select {
+	case KillChan <- true:
+	default:
+	}
 	return
 }
 
 func (s *GameOfLifeOperations) PressedKey(req stubs.KeyRequest, res *stubs.KeyResponse) (err error) {
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
 
-	res.Turns = GolTurn
-	res.World = GolWorld
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	res.Turns = sess.turn
+	res.World, err = sess.currentWorld()
+	if err != nil {
+		return err
+	}
 	switch req.Key {
 	case 'p':
-		if s.Paused == false {
-			s.Paused = true
-		} else {
-			s.Paused = false
-		}
-	case 'q':
-		s.Quit = true
+		sess.paused = !sess.paused
 	case 'k':
-		s.Quit = true
+		sess.quit = true
 	}
+	// 'q' only detaches the controller, so the simulation carries on
 	return
 }
 
-// executeTurn performs a single evolution of the Game of Life
-func executeTurn(world [][]byte, height, width int) [][]byte {
-	newWorld := make([][]byte, height)
-	for i := range newWorld {
-		newWorld[i] = make([]byte, width)
-	}
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			aliveNeighbors := countAliveNeighbors(world, x, y, height, width)
-			currentCell := world[y][x]
-
-			// Apply Game of Life rules
-			if currentCell == 255 {
-				// Cell is currently alive
-				if aliveNeighbors < 2 || aliveNeighbors > 3 {
-					newWorld[y][x] = 0 // Dies
-				} else {
-					newWorld[y][x] = 255 // Stays alive
-				}
-			} else {
-				// Cell is currently dead
-				if aliveNeighbors == 3 {
-					newWorld[y][x] = 255 // Becomes alive
-				} else {
-					newWorld[y][x] = 0 // Stays dead
-				}
-			}
-		}
+// Inject stamps patterns from the library onto the world of a running session, between turns
+func (s *GameOfLifeOperations) Inject(req stubs.InjectRequest, res *stubs.InjectResponse) (err error) {
+	sess, err := s.session(req.Session)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.running() || sess.turn >= sess.turns || sess.quit {
+		return fmt.Errorf("session %v has finished", sess.id)
 	}
+	res.Turn = sess.turn
+	return sess.inject(req.Placements)
+}
 
-	return newWorld
+// RegisterWorker connects back to a worker process and adds it to the pool shared by the sessions
+func (s *GameOfLifeOperations) RegisterWorker(req stubs.RegisterRequest, res *stubs.RegisterResponse) (err error) {
+	client, err := rpc.Dial("tcp", req.Address)
+	if err != nil {
+		return err
+	}
+	s.Mu.Lock()
+	s.Workers = append(s.Workers, &worker{address: req.Address, client: client})
+	s.version++
+	s.Mu.Unlock()
+	fmt.Println("Registered worker", req.Address)
+	return
 }
 
-// countAliveNeighbors counts alive neighbors for a cell at (x, y)
-func countAliveNeighbors(world [][]byte, x, y, height, width int) int {
-	liveNeighbors := 0
-	for dy := -1; dy <= 1; dy++ {
-		for dx := -1; dx <= 1; dx++ {
-			if dx == 0 && dy == 0 {
-				continue // Skip the cell itself
-			}
-			neighborY := (y + dy + height) % height
-			neighborX := (x + dx + width) % width
-			if world[neighborY][neighborX] == 255 {
-				liveNeighbors++
-			}
+// DeregisterWorker removes a worker from the pool. If the worker holds part of any running simulation,
+// it does not return until the worker's strips have been handed to the remaining workers.
+func (s *GameOfLifeOperations) DeregisterWorker(req stubs.RegisterRequest, res *stubs.RegisterResponse) (err error) {
+	s.Mu.Lock()
+	var leaving *worker
+	for i, w := range s.Workers {
+		if w.address == req.Address {
+			leaving = w
+			s.Workers = append(s.Workers[:i:i], s.Workers[i+1:]...)
+			s.version++
+			break
 		}
 	}
-	return liveNeighbors
+	if leaving == nil {
+		s.Mu.Unlock()
+		return fmt.Errorf("worker %v is not registered", req.Address)
+	}
+	if leaving.clusters == 0 {
+		s.Mu.Unlock()
+		leaving.client.Close()
+		fmt.Println("Deregistered worker", req.Address)
+		return
+	}
+
+	// Wait for the sessions using the worker to move its strips elsewhere at their next turn boundary
+	done := make(chan bool)
+	leaving.leaving = done
+	s.Mu.Unlock()
+	<-done
+	fmt.Println("Deregistered worker", req.Address)
+	return
 }
 
-// countAliveCells counts the number of alive cells in the world
-func countAliveCells(world [][]byte) int {
-	aliveCount := 0
-	for y := 0; y < len(world); y++ {
-		for x := 0; x < len(world[y]); x++ {
-			if world[y][x] == 255 { // Alive cell
-				aliveCount++
-			}
+// acquire returns the workers a session should split its world between, at most one per strip,
+// along with the version of the pool they were drawn from.
+func (s *GameOfLifeOperations) acquire(strips int) ([]*worker, int) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	workers := s.Workers
+	if len(workers) > strips {
+		workers = workers[:strips]
+	}
+	for _, w := range workers {
+		w.clusters++
+	}
+	return workers, s.version
+}
+
+// release gives back workers taken by acquire, letting go of any that have deregistered once
+// they no longer hold any strips.
+func (s *GameOfLifeOperations) release(workers []*worker) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for _, w := range workers {
+		w.clusters--
+		if w.clusters == 0 && w.leaving != nil {
+			w.client.Close()
+			close(w.leaving)
+			w.leaving = nil
 		}
 	}
-	return aliveCount
 }
 
-// findAliveCells collects the coordinates of all live cells in the world
-func findAliveCells(world [][]byte) []util.Cell {
-	aliveCells := []util.Cell{}
-	for y := 0; y < len(world); y++ {
-		for x := 0; x < len(world[y]); x++ {
-			if world[y][x] == 255 { // Alive cell
-				aliveCells = append(aliveCells, util.Cell{Y: y, X: x})
+// poolVersion returns the current version of the worker pool.
+func (s *GameOfLifeOperations) poolVersion() int {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.version
+}
+
+// dropWorkers removes failed workers from the pool, reporting whether there were any.
+func (s *GameOfLifeOperations) dropWorkers(dead []*worker, cause error) bool {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for _, d := range dead {
+		for i, w := range s.Workers {
+			if w == d {
+				s.Workers = append(s.Workers[:i:i], s.Workers[i+1:]...)
+				s.version++
+				fmt.Println("Worker", d.address, "failed:", cause)
+				break
 			}
 		}
+		if d.leaving != nil {
+			close(d.leaving)
+			d.leaving = nil
+		}
+		d.client.Close()
 	}
-	return aliveCells
+	return len(dead) > 0
 }
 
 func main() {
 	// Initialize the Game of Life RPC server
 	pAddr := flag.String("port", "8030", "Port to listen on")
+	flag.IntVar(&snapshotInterval, "snapshot", 50, "Turns between copies of the world kept in case a worker fails")
+	flag.DurationVar(&callTimeout, "timeout", 30*time.Second, "Time to wait for a worker before treating it as failed")
+	flag.StringVar(&checkpointDir, "checkpoint", "checkpoints", "Directory to write session checkpoints to, or empty to disable them")
+	flag.DurationVar(&checkpointInterval, "checkpointevery", time.Minute, "Time between checkpoints of a running session")
+	restore := flag.String("restore", "", "Checkpoint file to resume a session from")
+	flag.StringVar(&engineMode, "engine", "strips",
+		"Engine to evolve sessions with: strips, split between the workers; sparse, which also skips settled areas; "+
+			"or hashlife, which jumps many turns at once")
 	flag.Parse()
-	rand.Seed(time.Now().UnixNano())
-	rpc.Register(&GameOfLifeOperations{})
+	if engineMode != "strips" && engineMode != "sparse" && engineMode != "hashlife" {
+		fmt.Println("Unknown engine", engineMode)
+		return
+	}
+	ops := &GameOfLifeOperations{sessions: make(map[int]*session)}
+	rpc.Register(ops)
+	if checkpointDir != "" {
+		err := os.MkdirAll(checkpointDir, 0755)
+		if err != nil {
+			fmt.Println("Cannot write checkpoints:", err)
+			checkpointDir = ""
+		}
+	}
+	if *restore != "" {
+		_, err := ops.restore(*restore)
+		if err != nil {
+			fmt.Println("Cannot restore checkpoint:", err)
+			return
+		}
+	}
 	listener, _ := net.Listen("tcp", ":"+*pAddr)
 	defer listener.Close()
 	fmt.Println("Server started on port", *pAddr)
-	rpc.Accept(listener)
+	go rpc.Accept(listener)
+
+	// Give the KillServer reply a moment to reach the controller before exiting
+	<-KillChan
+	time.Sleep(100 * time.Millisecond)
+	fmt.Println("Server killed")
 }
@@ -0,0 +1,62 @@
+// server_test.go
+package main
+
+import (
+	"os"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/checkpoint"
+	"uk.ac.bris.cs/gameoflife/stubs"
+)
+
+// runSession starts a session of a blinker on a server with no workers and waits for it to finish.
+func runSession(t *testing.T, ops *GameOfLifeOperations, turns int) int {
+	t.Helper()
+	world := make([][]byte, 8)
+	for y := range world {
+		world[y] = make([]byte, 8)
+	}
+	world[4][3], world[4][4], world[4][5] = 255, 255, 255
+	started := new(stubs.StartResponse)
+	err := ops.Start(stubs.Request{InitialWorld: world, Turns: turns, ImageHeight: 8, ImageWidth: 8}, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.Wait(stubs.WaitRequest{Session: started.Session}, new(stubs.Response)); err != nil {
+		t.Fatal(err)
+	}
+	return started.Session
+}
+
+// TestCheckpointsAfterRestart tests that a restarted server, whose session IDs start again from 1,
+// leaves the checkpoints of the sessions run before the restart as they were.
+func TestCheckpointsAfterRestart(t *testing.T) {
+	checkpointDir = t.TempDir()
+	defer func() { checkpointDir = "" }()
+
+	first := runSession(t, &GameOfLifeOperations{sessions: make(map[int]*session)}, 3)
+	before, err := os.ReadFile(checkpointPath(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &GameOfLifeOperations{sessions: make(map[int]*session)}
+	second := runSession(t, restarted, 4)
+	if second == first {
+		t.Fatalf("session %v was started again after the restart", first)
+	}
+	after, err := os.ReadFile(checkpointPath(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("checkpoint of session %v was written over after the restart", first)
+	}
+	c, err := checkpoint.Read(checkpointPath(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Turn != 4 || c.Turns != 4 {
+		t.Errorf("checkpoint of session %v is of turn %v of %v, expected 4 of 4", second, c.Turn, c.Turns)
+	}
+}
@@ -0,0 +1,494 @@
+// session.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/checkpoint"
+	"uk.ac.bris.cs/gameoflife/engine"
+	"uk.ac.bris.cs/gameoflife/patterns"
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+const (
+	historyCells = 1 << 20          // Flipped cells kept across recent turns for controllers that fall behind
+	watchTimeout = 5 * time.Second  // Time after a controller last asked for changes that flips are still recorded
+	pollTimeout  = time.Second      // Longest a request for changes waits for a new turn
+	keepFinished = 10 * time.Minute // Time a finished session is kept for controllers to attach to if nobody collects its result
+
+	jumpTime = 100 * time.Millisecond // HashLife jumps taking less time than this grow, and ones taking much longer shrink
+	maxJump  = 40                     // Log2 of the most turns a single HashLife jump covers
+)
+
+// session is one simulation started by a controller. Several sessions can run on the server at once,
+// sharing the pool of workers.
+type session struct {
+	id  int
+	ops *GameOfLifeOperations
+	mu  sync.Mutex
+
+	world      [][]byte // World as of turn, unless the cluster holds it
+	turn       int
+	alive      int
+	cluster    *cluster         // Workers holding the world between them, or nil if it is evolved locally
+	sparse     *engine.Sparse   // Engine holding the world when it is evolved locally with the sparse engine
+	life       *engine.HashLife // Quadtree holding the world when the session uses the HashLife engine
+	step       int              // Log2 of the number of turns the next HashLife jump covers
+	version    int              // Version of the worker pool the cluster was drawn from
+	generation int              // Number of times the world has been handed out to workers
+	paused     bool
+	quit       bool
+
+	snapshot     [][]byte // Copy of the world as of snapshotTurn, to recover from worker failures
+	snapshotTurn int
+	checkpointed time.Time // When the session was last written to its checkpoint file
+
+	history     []stubs.Frame // Cells flipped in each of the most recent turns, while a controller is watching
+	historyFrom int           // Turn the first frame of history follows on from
+	flipped     int           // Number of cells in history
+	watched     time.Time     // When a controller last asked for changes
+	tick        chan struct{} // Closed and replaced whenever a turn completes
+	injected    stubs.Frame   // Cells stamped onto the world since the last turn, sent along with the next
+
+	height    int
+	width     int
+	turns     int
+	rule      engine.Rule
+	topology  engine.Topology
+	generator string        // Options the initial world was generated with, if it was
+	done      chan struct{} // Closed once the last turn has finished
+	result    stubs.Response
+	err       error
+	collected chan struct{} // Closed once Wait has handed the result to a controller
+	collect   sync.Once
+}
+
+// run processes each turn of the session, then records its final state and closes sess.done.
+func (sess *session) run() {
+	defer close(sess.done)
+
+	sess.checkpointed = time.Now()
+	for {
+		sess.mu.Lock()
+		// Check for quit signal
+		if sess.quit {
+			sess.mu.Unlock()
+			fmt.Println("Session", sess.id, "received quit signal. Ending simulation.")
+			break
+		}
+		if sess.turn >= sess.turns {
+			sess.mu.Unlock()
+			break
+		}
+
+		// Keep rebalancing while paused, so that departing workers are not held up
+		err := sess.rebalance()
+		if err == nil && !sess.paused {
+			err = sess.advance()
+		}
+		paused := sess.paused
+		if err != nil {
+			sess.dropCluster()
+		}
+		sess.mu.Unlock()
+		if err != nil {
+			sess.err = err
+			return
+		}
+
+		if paused {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if checkpointDir != "" && time.Since(sess.checkpointed) >= checkpointInterval {
+			sess.saveCheckpoint()
+		}
+	}
+
+	// Populate the response with the final world state and alive cells after final state
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	world, err := sess.currentWorld()
+	if err != nil {
+		sess.err = err
+		return
+	}
+	sess.world = world
+	sess.dropCluster()
+	sess.result.FinalWorld = world
+	sess.result.CompletedTurns = sess.turn
+	sess.result.AliveCellsAfterFinalState = engine.FindAliveCells(world)
+	if checkpointDir != "" {
+		sess.writeCheckpoint(world, sess.turn)
+	}
+}
+
+// saveCheckpoint writes the world as of the current turn to the session's checkpoint file.
+func (sess *session) saveCheckpoint() {
+	sess.mu.Lock()
+	world, err := sess.currentWorld()
+	turn := sess.turn
+	sess.mu.Unlock()
+	if err != nil {
+		fmt.Println("Session", sess.id, "checkpoint failed:", err)
+		return
+	}
+	sess.writeCheckpoint(world, turn)
+}
+
+// checkpointPath gives the file the session with the given ID is checkpointed to.
+func checkpointPath(id int) string {
+	return filepath.Join(checkpointDir, fmt.Sprintf("session%d.checkpoint", id))
+}
+
+// fileExists reports whether anything is at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil || !os.IsNotExist(err)
+}
+
+// writeCheckpoint writes the world as of turn to the session's checkpoint file.
+func (sess *session) writeCheckpoint(world [][]byte, turn int) {
+	sess.checkpointed = time.Now()
+	err := checkpoint.Write(checkpointPath(sess.id), checkpoint.Checkpoint{
+		ImageWidth:  sess.width,
+		ImageHeight: sess.height,
+		Turn:        turn,
+		Turns:       sess.turns,
+		Rule:        sess.rule.String(),
+		Topology:    sess.topology.String(),
+		Generator:   sess.generator,
+		World:       world,
+	})
+	if err != nil {
+		fmt.Println("Session", sess.id, "checkpoint failed:", err)
+	}
+}
+
+// running reports whether the session has still got turns to process.
+func (sess *session) running() bool {
+	select {
+	case <-sess.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// isPaused reports whether the session has been paused from the controller.
+func (sess *session) isPaused() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.paused
+}
+
+// advance moves the world on by one turn or, with the HashLife engine, by as many as it can jump at once.
+// sess.mu must be held.
+func (sess *session) advance() error {
+	// Cells stamped since the last turn go out with this one if anybody is watching, and never later
+	defer func() { sess.injected = stubs.Frame{} }()
+	if sess.life != nil {
+		sess.jump()
+		return nil
+	}
+	return sess.executeTurn(sess.turn + 1)
+}
+
+// inject stamps patterns onto the world as of sess.turn. Controllers watching the session are sent the
+// stamped cells along with the next turn. sess.mu must be held.
+func (sess *session) inject(placements []patterns.Placement) error {
+	world, err := sess.currentWorld()
+	if err != nil {
+		return err
+	}
+	stamped := make([][]byte, len(world))
+	for y, row := range world {
+		stamped[y] = append([]byte(nil), row...)
+	}
+	err = patterns.Place(stamped, placements...)
+	if err != nil {
+		return err
+	}
+
+	cells, greys := engine.ChangedCells(world, stamped, 0)
+	if sess.watching() {
+		sess.injected.Cells = append(sess.injected.Cells, cells...)
+		sess.injected.Greys = append(sess.injected.Greys, greys...)
+	}
+	sess.alive = engine.CountAliveCells(stamped)
+	if sess.life != nil {
+		sess.life.Replace(stamped)
+		return nil
+	}
+	return sess.distribute(stamped)
+}
+
+// jump moves the world on with the HashLife engine by a power of two turns, never past the last turn.
+// Jumps grow while they stay quick, so that long runs speed up as HashLife learns how the world
+// evolves, and shrink again if they slow down. sess.mu must be held.
+func (sess *session) jump() {
+	for sess.step > 0 && 1<<sess.step > sess.turns-sess.turn {
+		sess.step--
+	}
+	from := sess.turn
+	flips := sess.watching()
+	var before [][]byte
+	if flips {
+		before = sess.life.World()
+	}
+
+	start := time.Now()
+	sess.life.Step(sess.step)
+	elapsed := time.Since(start)
+	sess.turn += 1 << sess.step
+	sess.alive = sess.life.CountAlive()
+	if flips {
+		frame := stubs.Frame{Turn: sess.turn}
+		frame.Cells, frame.Greys = engine.ChangedCells(before, sess.life.World(), 0)
+		sess.record(from, frame)
+	}
+
+	switch {
+	case elapsed < jumpTime && sess.step < maxJump:
+		sess.step++
+	case elapsed > 4*jumpTime && sess.step > 0:
+		sess.step--
+	}
+}
+
+// executeTurn performs a single evolution of the Game of Life, either locally or on the
+// workers holding the world, and records the new turn and alive count. sess.mu must be held.
+func (sess *session) executeTurn(turn int) error {
+	flips := sess.watching()
+	if sess.sparse != nil {
+		sess.sparse.StepWorld()
+		if flips {
+			frame := stubs.Frame{Turn: turn}
+			frame.Cells, frame.Greys = sess.sparse.Changed()
+			sess.record(turn-1, frame)
+		}
+		sess.alive = sess.sparse.CountAlive()
+		sess.turn = turn
+		return nil
+	}
+	if sess.cluster == nil {
+		world := engine.NextWorld(sess.world, sess.height, sess.width, sess.rule, sess.topology)
+		if flips {
+			frame := stubs.Frame{Turn: turn}
+			frame.Cells, frame.Greys = engine.ChangedCells(sess.world, world, 0)
+			sess.record(turn-1, frame)
+		}
+		sess.world = world
+		sess.alive = engine.CountAliveCells(world)
+		sess.turn = turn
+		sess.snapshot, sess.snapshotTurn = world, turn
+		return nil
+	}
+
+	alive, frame, err := sess.cluster.turn(turn, flips)
+	if err != nil {
+		return sess.recover(turn, err)
+	}
+	if flips {
+		sess.record(turn-1, frame)
+	}
+	sess.alive = alive
+	sess.turn = turn
+
+	// Keep a recent copy of the world to fall back on if a worker fails
+	if turn-sess.snapshotTurn >= snapshotInterval {
+		world, err := sess.cluster.collect()
+		if err != nil {
+			return sess.recover(turn, err)
+		}
+		sess.snapshot, sess.snapshotTurn = world, turn
+	}
+	return nil
+}
+
+// watching reports whether a controller has asked for changes recently enough that the cells
+// flipped each turn should be recorded. sess.mu must be held.
+func (sess *session) watching() bool {
+	return time.Since(sess.watched) < watchTimeout
+}
+
+// record adds the cells changed between turn from and the frame's turn to the history, and wakes any
+// controllers waiting for it. Turns replayed after a worker failure are already in the history.
+// sess.mu must be held.
+func (sess *session) record(from int, frame stubs.Frame) {
+	if len(sess.history) > 0 {
+		last := sess.history[len(sess.history)-1].Turn
+		if frame.Turn <= last {
+			return
+		}
+		if from != last {
+			// Turns were missed while nobody was watching
+			sess.history, sess.flipped = nil, 0
+		}
+	}
+	if len(sess.history) == 0 {
+		sess.historyFrom = from
+	}
+	if len(sess.injected.Cells) > 0 {
+		// The turn's own changes come after the stamped cells, so they win where both changed a cell
+		frame.Cells = append(append([]util.Cell(nil), sess.injected.Cells...), frame.Cells...)
+		frame.Greys = append(append([]byte(nil), sess.injected.Greys...), frame.Greys...)
+	}
+	sess.history = append(sess.history, frame)
+	sess.flipped += len(frame.Cells)
+	for sess.flipped > historyCells && len(sess.history) > 1 {
+		sess.flipped -= len(sess.history[0].Cells)
+		sess.historyFrom = sess.history[0].Turn
+		sess.history = sess.history[1:]
+	}
+	close(sess.tick)
+	sess.tick = make(chan struct{})
+}
+
+// changes describes the turns completed after since, waiting up to pollTimeout for there to be any.
+func (sess *session) changes(since int, res *stubs.ChangesResponse) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.watched = time.Now()
+	if sess.turn <= since && sess.running() {
+		tick := sess.tick
+		sess.mu.Unlock()
+		select {
+		case <-tick:
+		case <-sess.done:
+		case <-time.After(pollTimeout):
+		}
+		sess.mu.Lock()
+	}
+
+	res.Turn = sess.turn
+	res.Finished = !sess.running()
+	if res.Finished && sess.err != nil {
+		return sess.err
+	}
+	if res.Turn <= since {
+		return nil
+	}
+	if n := len(sess.history); n > 0 && sess.history[n-1].Turn == res.Turn {
+		if since == sess.historyFrom {
+			res.Frames = sess.history
+			return nil
+		}
+		for i, frame := range sess.history {
+			if frame.Turn == since {
+				res.Frames = sess.history[i+1:]
+				return nil
+			}
+		}
+	}
+
+	// The turns after since are no longer all held, so send the whole world instead
+	var err error
+	res.World, err = sess.currentWorld()
+	return err
+}
+
+// recover drops the workers that have stopped responding, hands the last snapshot of the world to
+// the survivors and replays the turns since, up to turn. sess.mu is held throughout, so nobody else
+// sees the turn go backwards.
+func (sess *session) recover(turn int, cause error) error {
+	if !sess.ops.dropWorkers(deadWorkers(sess.cluster.workers), cause) {
+		return cause
+	}
+	from := sess.snapshotTurn
+	sess.turn = from
+	err := sess.distribute(sess.snapshot)
+	if err != nil {
+		return err
+	}
+	for t := from + 1; t <= turn; t++ {
+		err = sess.executeTurn(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// distribute hands the world as of sess.turn out to the registered workers, dropping any that fail
+// to take their strip. With no workers left the world is evolved locally. sess.mu must be held.
+func (sess *session) distribute(world [][]byte) error {
+	sess.dropCluster()
+	sess.world = world
+	sess.sparse = nil
+	sess.snapshot, sess.snapshotTurn = world, sess.turn
+	for {
+		// Every strip must be at least as tall as the halos its neighbours borrow from it
+		workers, version := sess.ops.acquire(sess.height / sess.rule.Radius)
+		sess.version = version
+		if len(workers) == 0 {
+			if engineMode == "sparse" {
+				sess.sparse = engine.NewSparse(world, 0, sess.height, sess.width, sess.rule, sess.topology)
+			}
+			return nil
+		}
+
+		sess.generation++
+		c, err := startCluster(workers, sess.id, sess.generation, world, sess.height, sess.width, sess.rule, sess.topology, engineMode == "sparse")
+		if err == nil {
+			sess.cluster = c
+			return nil
+		}
+		sess.ops.release(workers)
+		if !sess.ops.dropWorkers(deadWorkers(workers), err) {
+			return err
+		}
+	}
+}
+
+// rebalance hands the world out afresh if workers have joined or left the pool since it was last
+// handed out. It is called at turn boundaries. sess.mu must be held.
+func (sess *session) rebalance() error {
+	if sess.life != nil || sess.ops.poolVersion() == sess.version {
+		return nil
+	}
+
+	world, err := sess.currentWorld()
+	if err != nil {
+		return err
+	}
+	return sess.distribute(world)
+}
+
+// dropCluster takes the world back from the workers, which must already have been gathered into
+// sess.world. sess.mu must be held.
+func (sess *session) dropCluster() {
+	if sess.cluster == nil {
+		return
+	}
+	sess.cluster.release()
+	sess.ops.release(sess.cluster.workers)
+	sess.cluster = nil
+}
+
+// currentWorld returns the world as of sess.turn, gathering it from the workers if they hold it.
+// sess.mu must be held.
+func (sess *session) currentWorld() ([][]byte, error) {
+	if sess.life != nil {
+		return sess.life.World(), nil
+	}
+	if sess.sparse != nil {
+		return sess.sparse.Strip(), nil
+	}
+	if sess.cluster == nil {
+		return sess.world, nil
+	}
+	world, err := sess.cluster.collect()
+	if err == nil {
+		return world, nil
+	}
+	err = sess.recover(sess.turn, err)
+	if err != nil {
+		return nil, err
+	}
+	return sess.currentWorld()
+}
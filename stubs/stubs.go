@@ -1,13 +1,29 @@
 // stubs.go
 package stubs
 
-import "uk.ac.bris.cs/gameoflife/util"
+import (
+	"uk.ac.bris.cs/gameoflife/patterns"
+	"uk.ac.bris.cs/gameoflife/util"
+)
 
 // RPC method names
 var ServerHandler = "GameOfLifeOperations.GOL"
+var StartHandler = "GameOfLifeOperations.Start"
+var WaitHandler = "GameOfLifeOperations.Wait"
+var AttachHandler = "GameOfLifeOperations.Attach"
+var ChangesHandler = "GameOfLifeOperations.Changes"
 var AliveCellReport = "GameOfLifeOperations.Alive"
 var KeyPresshandler = "GameOfLifeOperations.PressedKey"
-var KillServerHandler = "GOLOperations.KillServer"
+var KillServerHandler = "GameOfLifeOperations.KillServer"
+var InjectHandler = "GameOfLifeOperations.Inject"
+var RegisterWorkerHandler = "GameOfLifeOperations.RegisterWorker"
+var DeregisterWorkerHandler = "GameOfLifeOperations.DeregisterWorker"
+var WorkerInitHandler = "WorkerOperations.Init"
+var WorkerTurnHandler = "WorkerOperations.Turn"
+var WorkerCollectHandler = "WorkerOperations.Collect"
+var HaloHandler = "WorkerOperations.PutHalo"
+var PingHandler = "WorkerOperations.Ping"
+var ReleaseHandler = "WorkerOperations.Release"
 
 const (
 	Paused    = "Paused"
@@ -21,7 +37,7 @@ type EmptyResponse struct{}
 
 // WorldState represents the current state of the Game of Life world
 type WorldState struct {
-	World [][]byte
+	World World
 }
 
 // PauseResumeRequest represents a request to pause or resume the simulation
@@ -31,7 +47,7 @@ type PauseResumeRequest struct {
 
 // Response represents the response structure for the Game of Life evolution result
 type Response struct {
-	FinalWorld                [][]byte    // Final world state after evolution
+	FinalWorld                World       // Final world state after evolution
 	CompletedTurns            int         // Number of turns completed
 	AliveCellsAfterFinalState []util.Cell // Number of alive cells after the final state
 	NewState                  string
@@ -39,10 +55,63 @@ type Response struct {
 
 // Request represents the request structure for initializing the Game of Life simulation
 type Request struct {
-	InitialWorld [][]byte // Initial state of the world grid
-	ImageHeight  int      // Height of the world grid
-	ImageWidth   int      // Width of the world grid
-	Turns        int      // Number of turns to process
+	InitialWorld World  // Initial state of the world grid
+	ImageHeight  int    // Height of the world grid
+	ImageWidth   int    // Width of the world grid
+	Turns        int    // Number of turns to process
+	Turn         int    // Number of turns InitialWorld has already been through, when resuming from a checkpoint
+	Rule         string // Rule set in Birth/Survival or Larger than Life notation, such as "B3/S23"; empty for Conway's
+	Topology     string // Surface the world is drawn on, such as "klein-bottle"; empty for a torus
+	Generator    string // Options InitialWorld was generated with, such as "generate=random density=0.5 seed=42"; empty if it was loaded
+}
+
+// StartResponse carries the handle of a simulation started in the background
+type StartResponse struct {
+	Session int
+}
+
+// WaitRequest asks the server to block until a simulation has finished
+type WaitRequest struct {
+	Session int
+}
+
+// AttachRequest asks to join a running simulation
+type AttachRequest struct {
+	Session int  // Session to join, or 0 for the most recently started one
+	NoWorld bool // Leave the world out of the response, for a controller finding out what it is joining
+}
+
+// ChangesRequest waits for a session to complete turns after Since
+type ChangesRequest struct {
+	Session int
+	Since   int // Last turn the controller has seen
+}
+
+// Frame lists the cells that changed during one turn
+type Frame struct {
+	Turn  int
+	Cells []util.Cell
+	Greys []byte // Grey level each cell has changed to
+}
+
+// ChangesResponse carries the turns a session has completed since the controller last asked
+type ChangesResponse struct {
+	Frames   []Frame // Turns after Since, in order
+	World    World   // The world as of Turn, sent instead of Frames when the server no longer has them all
+	Turn     int     // Latest completed turn
+	Finished bool    // Whether the session has finished, so that no more turns will follow
+}
+
+// AttachResponse describes the running simulation a controller has joined
+type AttachResponse struct {
+	Session     int   // Handle to Wait on
+	World       World // World as of Turn
+	Turn        int   // Number of turns completed so far
+	ImageHeight int
+	ImageWidth  int
+	Turns       int    // Number of turns the simulation will process
+	Rule        string // Rule set in Birth/Survival or Larger than Life notation
+	Topology    string // Surface the world is drawn on
 }
 
 // AliveResponse represents the response for the current alive cell count and turn number
@@ -53,19 +122,108 @@ type AliveResponse struct {
 
 // AliveRequest represents a request to retrieve the current alive cell count
 type AliveRequest struct {
+	Session     int // Session to report on
 	ImageHeight int // Height of the world grid (used if needed)
 	ImageWidth  int // Width of the world grid (used if needed)
 }
 
 type KeyResponse struct {
-	World [][]byte
+	World World
 	Turns int
 }
 
 type KillRequest struct {
+	Session int
 }
 type KeyRequest struct {
-	Key rune
+	Session int
+	Key     rune
 }
 type KillResponse struct {
 }
+
+// InjectRequest asks the server to stamp patterns from the library onto a running simulation
+type InjectRequest struct {
+	Session    int
+	Placements []patterns.Placement
+}
+type InjectResponse struct {
+	Turn int // Turn after which the patterns were stamped onto the world
+}
+
+// RegisterRequest is sent by a worker to announce (or withdraw) the address it serves WorkerOperations on
+type RegisterRequest struct {
+	Address string
+}
+type RegisterResponse struct {
+}
+
+// InitRequest hands a worker its strip of the world and the addresses of its neighbours
+type InitRequest struct {
+	Session     int    // Session the strip belongs to
+	Strip       World  // Rows of the strip, without halos
+	StartY      int    // Row of the world the strip starts at
+	ImageHeight int    // Height of the world grid
+	ImageWidth  int    // Width of the world grid
+	Rule        string // Rule set in Birth/Survival or Larger than Life notation
+	Topology    string // Surface the world is drawn on
+	Above       string // Address of the worker holding the strip above
+	Below       string // Address of the worker holding the strip below
+	Generation  int    // Distinguishes this assignment of strips from earlier ones
+	Sparse      bool   // Whether to evolve the strip with the sparse engine, which skips settled areas
+}
+type InitResponse struct {
+}
+
+// TurnRequest is the barrier the server sends to every worker to start a turn
+type TurnRequest struct {
+	Session   int
+	Turn      int   // Number of completed turns once this turn is done
+	Flips     bool  // Whether to report the cells that flipped during the turn
+	Sides     World // Side columns of the rows the strip needs, on topologies that need them
+	SidesFrom int   // Row of the world the first of Sides belongs to, the rest following on past the bottom edge to the top
+}
+
+// TurnResponse reports a worker's share of the alive cells after a turn
+type TurnResponse struct {
+	AliveCellsCount int
+	Flipped         []util.Cell // Cells of the strip that changed, if asked for, with Y relative to the strip
+	Greys           []byte      // Grey level each changed cell has changed to
+	Sides           World       // Side columns of the strip's new rows, on topologies that need them
+}
+
+// HaloRequest carries the boundary rows from one worker to its neighbour. Under the sparse engine,
+// rows that have not changed since the last turn are left out.
+type HaloRequest struct {
+	Session int
+	Turn    int   // Turn the halo rows are needed for
+	Rows    World // Boundary rows of the sending worker's strip, as many as the rule's radius
+	Top     bool  // Whether the rows are the receiver's top halo (otherwise its bottom halo)
+
+	Generation int // Assignment of strips the rows belong to
+}
+type HaloResponse struct {
+}
+
+type CollectRequest struct {
+	Session int
+}
+
+// CollectResponse carries a worker's current strip back to the server
+type CollectResponse struct {
+	Strip World
+}
+
+// ReleaseRequest tells a worker it no longer holds a strip for a session
+type ReleaseRequest struct {
+	Session    int
+	Generation int // Only release the strip if it is still from this assignment
+}
+type ReleaseResponse struct {
+}
+
+// PingRequest is the heartbeat the server sends to check a worker is still alive
+type PingRequest struct {
+}
+type PingResponse struct {
+}
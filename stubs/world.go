@@ -0,0 +1,123 @@
+// world.go
+package stubs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"uk.ac.bris.cs/gameoflife/engine"
+)
+
+// World is a world of cells stored as grey levels, as sent between the controller, server and workers.
+// A world whose cells are all either dead or alive, as they always are under two-state rules, is
+// bit-packed on the wire, taking an eighth of the space.
+//
+// On the wire a world is its height and width as uvarints, then a byte saying whether it is packed,
+// then either the words of an engine.Grid as little-endian uint64s or the rows of grey levels.
+type World [][]byte
+
+const (
+	rawWorld    = 0
+	packedWorld = 1
+)
+
+// maxWorldSide is the most cells a side of a world can have. It keeps the size read from the wire from
+// overflowing when the sides are multiplied, so that it can be checked against the data sent.
+const maxWorldSide = 1 << 24
+
+// GobEncode packs the world for sending. Every row must be the same length, and not empty.
+func (w World) GobEncode() ([]byte, error) {
+	height, width := len(w), 0
+	if height > 0 {
+		width = len(w[0])
+	}
+	for y, row := range w {
+		if len(row) != width {
+			return nil, fmt.Errorf("world row %v has %v cells, but row 0 has %v", y, len(row), width)
+		}
+	}
+	if height > 0 && width == 0 {
+		return nil, fmt.Errorf("world has %v rows but no cells", height)
+	}
+	header := make([]byte, 2*binary.MaxVarintLen64+1)
+	n := binary.PutUvarint(header, uint64(height))
+	n += binary.PutUvarint(header[n:], uint64(width))
+
+	if !twoState(w) {
+		header[n] = rawWorld
+		data := make([]byte, 0, n+1+height*width)
+		data = append(data, header[:n+1]...)
+		for _, row := range w {
+			data = append(data, row...)
+		}
+		return data, nil
+	}
+
+	header[n] = packedWorld
+	words := engine.PackGrid(w, height, width).Words()
+	data := make([]byte, n+1+8*len(words))
+	copy(data, header[:n+1])
+	for i, word := range words {
+		binary.LittleEndian.PutUint64(data[n+1+8*i:], word)
+	}
+	return data, nil
+}
+
+// GobDecode unpacks a world sent by GobEncode, refusing it before anything is allocated for it if its
+// size does not match the data sent.
+func (w *World) GobDecode(data []byte) error {
+	height, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("invalid world height")
+	}
+	data = data[n:]
+	width, n := binary.Uvarint(data)
+	if n <= 0 || len(data) == n {
+		return errors.New("invalid world width")
+	}
+	if height > maxWorldSide || width > maxWorldSide || height > 0 && width == 0 {
+		// Rows without cells could be claimed in any number without any data to back them
+		return fmt.Errorf("invalid world size %dx%d", width, height)
+	}
+	format, data := data[n], data[n+1:]
+
+	switch format {
+	case rawWorld:
+		if uint64(len(data)) != height*width {
+			return errors.New("world data is the wrong length")
+		}
+		// The decoder reuses data, so take a copy
+		cells := make([]byte, len(data))
+		copy(cells, data)
+		world := make([][]byte, height)
+		for y := range world {
+			world[y] = cells[uint64(y)*width : uint64(y+1)*width : uint64(y+1)*width]
+		}
+		*w = world
+	case packedWorld:
+		words := make([]uint64, len(data)/8)
+		if uint64(len(words)) != height*((width+63)/64) || len(data)%8 != 0 {
+			return errors.New("world data is the wrong length")
+		}
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint64(data[8*i:])
+		}
+		*w = engine.GridFromWords(words, int(height), int(width)).Unpack()
+	default:
+		return errors.New("unknown world encoding")
+	}
+	return nil
+}
+
+// twoState reports whether every cell of the world is either dead or alive.
+func twoState(w World) bool {
+	for _, row := range w {
+		for _, cell := range row {
+			if cell != 0 && cell != 255 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+// world_test.go
+package stubs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"testing"
+)
+
+// TestWorldGob tests that worlds come back from gob as they went in, packed or not.
+func TestWorldGob(t *testing.T) {
+	tests := []struct {
+		name   string
+		world  World
+		packed bool
+	}{
+		{"nil", nil, true},
+		{"two-state", World{{0, 255, 0}, {255, 255, 0}}, true},
+		{"two-state wider than a word", twoStateWorld(70, 5), true},
+		{"grey", World{{0, 255, 85}, {170, 0, 255}}, false},
+		{"one grey cell", twoStateWorld(130, 3), false},
+	}
+	tests[len(tests)-1].world[2][129] = 128
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := test.world.GobEncode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, n := binary.Uvarint(data)
+			_, m := binary.Uvarint(data[n:])
+			if packed := data[n+m] == packedWorld; packed != test.packed {
+				t.Errorf("packed %v, expected %v", packed, test.packed)
+			}
+
+			// Send it inside a response, as the server does
+			var buf bytes.Buffer
+			err = gob.NewEncoder(&buf).Encode(Response{FinalWorld: test.world, CompletedTurns: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Response
+			err = gob.NewDecoder(&buf).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.FinalWorld) != len(test.world) {
+				t.Fatalf("height %v, expected %v", len(got.FinalWorld), len(test.world))
+			}
+			for y := range test.world {
+				if !bytes.Equal(got.FinalWorld[y], test.world[y]) {
+					t.Fatalf("row %v is %v, expected %v", y, got.FinalWorld[y], test.world[y])
+				}
+			}
+		})
+	}
+}
+
+// TestWorldGobRagged tests that a world with rows of different lengths is refused rather than garbled.
+func TestWorldGobRagged(t *testing.T) {
+	for _, world := range []World{{{0, 255}, {0}}, {{}, {255}}, {{128, 0}, {0, 0, 0}}, {{}, {}}} {
+		if _, err := world.GobEncode(); err == nil {
+			t.Errorf("%v encoded without error", world)
+		}
+	}
+}
+
+// TestWorldGobInvalid tests that data that is not a world is refused.
+func TestWorldGobInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		nil, {2}, {2, 2}, {2, 2, rawWorld, 0}, {1, 1, packedWorld, 1}, {1, 1, 7},
+		// Sizes that would have a huge world allocated for next to no data
+		worldHeader(1<<40, 0, rawWorld), worldHeader(1<<40, 0, packedWorld), worldHeader(maxWorldSide+1, 1, rawWorld),
+		// Sizes whose product overflows to the length of the data
+		worldHeader(1<<32, 1<<32, rawWorld), append(worldHeader(1<<63+1, 2, rawWorld), 0, 0),
+	} {
+		var w World
+		if err := w.GobDecode(data); err == nil {
+			t.Errorf("%v decoded without error", data)
+		}
+	}
+}
+
+// worldHeader gives the start of an encoded world: its height, width and format.
+func worldHeader(height, width uint64, format byte) []byte {
+	header := make([]byte, 2*binary.MaxVarintLen64+1)
+	n := binary.PutUvarint(header, height)
+	n += binary.PutUvarint(header[n:], width)
+	header[n] = format
+	return header[:n+1]
+}
+
+func twoStateWorld(width, height int) World {
+	world := make(World, height)
+	for y := range world {
+		world[y] = make([]byte, width)
+		for x := range world[y] {
+			if (x*7+y*3)%5 < 2 {
+				world[y][x] = 255
+			}
+		}
+	}
+	return world
+}
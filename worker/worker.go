@@ -0,0 +1,383 @@
+// worker.go
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/engine"
+	"uk.ac.bris.cs/gameoflife/stubs"
+)
+
+// haloKey identifies a halo a worker is waiting for
+type haloKey struct {
+	turn int
+	top  bool
+}
+
+// assignment is the strip of one session's world held by this worker
+type assignment struct {
+	strip    [][]byte
+	sparse   *engine.Sparse // Engine holding the strip in place of strip, under the sparse engine
+	startY   int            // Row of the world the strip starts at
+	height   int            // Height of the whole world
+	width    int
+	rule     engine.Rule
+	topology engine.Topology
+	above    string // Address of the worker holding the strip above
+	below    string // Address of the worker holding the strip below
+	halos    map[haloKey]chan [][]byte
+	reset    chan struct{} // Closed when the strip is replaced, to abandon turns in progress
+	sides    [][]byte      // Side columns of the world's rows, of which only those the strip needs are kept up to date
+
+	generation int
+}
+
+// WorkerOperations struct that serves the worker RPC methods
+type WorkerOperations struct {
+	mu          sync.Mutex
+	peers       map[string]*rpc.Client
+	assignments map[int]*assignment // Strips held by this worker, by session
+}
+
+// haloTimeout is how long to wait for a neighbour's halo rows before giving up on a turn
+const haloTimeout = 10 * time.Second
+
+// peer returns a client for the worker at address, dialling it the first time it is needed.
+// w.mu must be held.
+func (w *WorkerOperations) peer(address string) (*rpc.Client, error) {
+	if client, ok := w.peers[address]; ok {
+		return client, nil
+	}
+	client, err := rpc.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	w.peers[address] = client
+	return client, nil
+}
+
+// forget drops a broken connection to a peer so that it is dialled afresh next time.
+func (w *WorkerOperations) forget(address string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if client, ok := w.peers[address]; ok {
+		delete(w.peers, address)
+		client.Close()
+	}
+}
+
+// assignment looks up the strip held for a session. w.mu must be held.
+func (w *WorkerOperations) assignment(session int) (*assignment, error) {
+	a, ok := w.assignments[session]
+	if !ok {
+		return nil, fmt.Errorf("no strip held for session %v", session)
+	}
+	return a, nil
+}
+
+// mailbox returns the channel the halo rows for key are delivered on. w.mu must be held.
+func (a *assignment) mailbox(key haloKey) chan [][]byte {
+	ch, ok := a.halos[key]
+	if !ok {
+		ch = make(chan [][]byte, 1)
+		a.halos[key] = ch
+	}
+	return ch
+}
+
+// Init stores the strip of a session's world this worker is responsible for and connects to its neighbours.
+func (w *WorkerOperations) Init(req stubs.InitRequest, res *stubs.InitResponse) (err error) {
+	rule, err := engine.ParseRule(req.Rule)
+	if err != nil {
+		return err
+	}
+	topology, err := engine.ParseTopology(req.Topology)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.peer(req.Above)
+	if err != nil {
+		return err
+	}
+	_, err = w.peer(req.Below)
+	if err != nil {
+		return err
+	}
+	if old, ok := w.assignments[req.Session]; ok {
+		close(old.reset)
+	}
+	a := &assignment{
+		strip:      req.Strip,
+		startY:     req.StartY,
+		height:     req.ImageHeight,
+		width:      req.ImageWidth,
+		rule:       rule,
+		topology:   topology,
+		above:      req.Above,
+		below:      req.Below,
+		halos:      make(map[haloKey]chan [][]byte),
+		reset:      make(chan struct{}),
+		generation: req.Generation,
+	}
+	if topology.NeedsSides() {
+		a.sides = make([][]byte, req.ImageHeight)
+	}
+	if req.Sparse {
+		a.strip = nil
+		a.sparse = engine.NewSparse(req.Strip, req.StartY, req.ImageHeight, req.ImageWidth, rule, topology)
+	}
+	w.assignments[req.Session] = a
+	return
+}
+
+// rows gives the rows of the strip as of the last completed turn.
+func (a *assignment) rows() [][]byte {
+	if a.sparse != nil {
+		return a.sparse.Rows()
+	}
+	return a.strip
+}
+
+// placeSides puts the side columns the server sent for a turn in place among those of the whole world,
+// where the engine looks them up.
+func (a *assignment) placeSides(req stubs.TurnRequest) [][]byte {
+	if a.sides == nil {
+		return nil
+	}
+	for i, side := range req.Sides {
+		a.sides[(req.SidesFrom+i)%a.height] = side
+	}
+	return a.sides
+}
+
+// Release forgets the strip held for a session, unless it has since been replaced.
+func (w *WorkerOperations) Release(req stubs.ReleaseRequest, res *stubs.ReleaseResponse) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if a, ok := w.assignments[req.Session]; ok && a.generation == req.Generation {
+		close(a.reset)
+		delete(w.assignments, req.Session)
+	}
+	return
+}
+
+// Ping answers the server's heartbeat.
+func (w *WorkerOperations) Ping(req stubs.PingRequest, res *stubs.PingResponse) (err error) {
+	return
+}
+
+// PutHalo delivers the boundary rows of a neighbouring worker.
+// Rows left over from an earlier assignment of strips are dropped.
+func (w *WorkerOperations) PutHalo(req stubs.HaloRequest, res *stubs.HaloResponse) (err error) {
+	w.mu.Lock()
+	a, ok := w.assignments[req.Session]
+	if !ok || req.Generation != a.generation {
+		w.mu.Unlock()
+		return
+	}
+	mailbox := a.mailbox(haloKey{req.Turn, req.Top})
+	w.mu.Unlock()
+	select {
+	case mailbox <- req.Rows:
+	default:
+	}
+	return
+}
+
+// awaitHalo waits for the halo rows identified by key to be delivered.
+func (w *WorkerOperations) awaitHalo(a *assignment, key haloKey) ([][]byte, error) {
+	w.mu.Lock()
+	mailbox := a.mailbox(key)
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(a.halos, key)
+		w.mu.Unlock()
+	}()
+	select {
+	case rows := <-mailbox:
+		return rows, nil
+	case <-a.reset:
+		return nil, errors.New("strip was reassigned")
+	case <-time.After(haloTimeout):
+		return nil, fmt.Errorf("timed out waiting for halo rows for turn %v", key.turn)
+	}
+}
+
+// sendHalo starts sending our boundary rows on one side to a neighbour.
+func (w *WorkerOperations) sendHalo(address string, req stubs.HaloRequest) (*rpc.Call, error) {
+	w.mu.Lock()
+	client, err := w.peer(address)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return client.Go(stubs.HaloHandler, req, new(stubs.HaloResponse), nil), nil
+}
+
+// Turn swaps boundary rows with the neighbouring workers and advances a session's strip by one turn.
+func (w *WorkerOperations) Turn(req stubs.TurnRequest, res *stubs.TurnResponse) (err error) {
+	w.mu.Lock()
+	a, err := w.assignment(req.Session)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	strip := a.rows()
+	radius := a.rule.Radius
+
+	// Our top rows are the bottom halo of the strip above, and our bottom rows the top halo of the strip below
+	halos := []struct {
+		address string
+		request stubs.HaloRequest
+	}{
+		{a.above, stubs.HaloRequest{Session: req.Session, Turn: req.Turn, Rows: strip[:radius], Top: false, Generation: a.generation}},
+		{a.below, stubs.HaloRequest{Session: req.Session, Turn: req.Turn, Rows: strip[len(strip)-radius:], Top: true, Generation: a.generation}},
+	}
+	if a.sparse != nil {
+		// The neighbours still have the rows we sent them last unless they have changed since
+		if !a.sparse.BoundaryChanged(true) {
+			halos[0].request.Rows = nil
+		}
+		if !a.sparse.BoundaryChanged(false) {
+			halos[1].request.Rows = nil
+		}
+	}
+	calls := make([]*rpc.Call, len(halos))
+	for i, halo := range halos {
+		calls[i], err = w.sendHalo(halo.address, halo.request)
+		if err != nil {
+			return err
+		}
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			w.forget(halos[i].address)
+			return call.Error
+		}
+	}
+
+	topHalo, err := w.awaitHalo(a, haloKey{req.Turn, true})
+	if err != nil {
+		return err
+	}
+	bottomHalo, err := w.awaitHalo(a, haloKey{req.Turn, false})
+	if err != nil {
+		return err
+	}
+
+	if a.sparse != nil {
+		return w.stepSparse(a, req, res, topHalo, bottomHalo)
+	}
+
+	padded := make([][]byte, 0, len(strip)+2*radius)
+	padded = append(padded, topHalo...)
+	padded = append(padded, strip...)
+	padded = append(padded, bottomHalo...)
+	newStrip := engine.NextStrip(padded, a.startY, a.height, a.width, a.rule, a.topology, a.placeSides(req))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.assignments[req.Session] != a {
+		return errors.New("strip was reassigned")
+	}
+	a.strip = newStrip
+	res.AliveCellsCount = engine.CountAliveCells(newStrip)
+	if req.Flips {
+		res.Flipped, res.Greys = engine.ChangedCells(strip, newStrip, 0)
+	}
+	if a.topology.NeedsSides() {
+		res.Sides = engine.SideColumns(newStrip, radius)
+	}
+	return
+}
+
+// stepSparse advances a strip held by the sparse engine by one turn, given its halo rows, of which
+// those left out by a neighbour are unchanged.
+func (w *WorkerOperations) stepSparse(a *assignment, req stubs.TurnRequest, res *stubs.TurnResponse, topHalo, bottomHalo [][]byte) error {
+	a.sparse.Step(topHalo, bottomHalo, a.placeSides(req))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.assignments[req.Session] != a {
+		return errors.New("strip was reassigned")
+	}
+	res.AliveCellsCount = a.sparse.CountAlive()
+	if req.Flips {
+		// Only cells in the tiles the engine worked out can have changed, so there is no need to compare strips
+		res.Flipped, res.Greys = a.sparse.Changed()
+	}
+	if a.topology.NeedsSides() {
+		res.Sides = engine.SideColumns(a.sparse.Rows(), a.rule.Radius)
+	}
+	return nil
+}
+
+// Collect returns a session's strip as of the last completed turn.
+func (w *WorkerOperations) Collect(req stubs.CollectRequest, res *stubs.CollectResponse) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	a, err := w.assignment(req.Session)
+	if err != nil {
+		return err
+	}
+	res.Strip = a.strip
+	if a.sparse != nil {
+		res.Strip = a.sparse.Strip()
+	}
+	return
+}
+
+func main() {
+	// Initialize the worker RPC server and register it with the Game of Life server
+	pAddr := flag.String("port", "8040", "Port to listen on")
+	ip := flag.String("ip", "localhost", "Address the server and other workers should use to reach this worker")
+	server := flag.String("server", "localhost:8030", "Address of the Game of Life server")
+	flag.Parse()
+	rpc.Register(&WorkerOperations{
+		peers:       make(map[string]*rpc.Client),
+		assignments: make(map[int]*assignment),
+	})
+	listener, err := net.Listen("tcp", ":"+*pAddr)
+	if err != nil {
+		log.Fatal("Listen Error:", err)
+	}
+
+	client, err := rpc.Dial("tcp", *server)
+	if err != nil {
+		log.Fatal("Error connecting to server:", err)
+	}
+	defer client.Close()
+	request := stubs.RegisterRequest{Address: *ip + ":" + *pAddr}
+	err = client.Call(stubs.RegisterWorkerHandler, request, new(stubs.RegisterResponse))
+	if err != nil {
+		log.Fatal("Register Call Error:", err)
+	}
+
+	fmt.Println("Worker started on port", *pAddr)
+	go rpc.Accept(listener)
+
+	// Leave the pool cleanly when interrupted, so the server can move our strip elsewhere first
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGINT)
+	<-sigterm
+	err = client.Call(stubs.DeregisterWorkerHandler, request, new(stubs.RegisterResponse))
+	if err != nil {
+		log.Fatal("Deregister Call Error:", err)
+	}
+	fmt.Println("Worker deregistered")
+}